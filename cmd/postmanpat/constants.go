@@ -5,7 +5,38 @@ const STORAGE_BUCKET = "postmanpat"
 const TF_VAR_PREFIX = "TF_VAR_"
 const DIGITALOCEAN_BUCKET_ACCESS_KEY = "DIGITALOCEAN_BUCKET_ACCESS_KEY"
 const DIGITALOCEAN_BUCKET_SECRET_KEY = "DIGITALOCEAN_BUCKET_SECRET_KEY"
+const EXPORTS_STORAGE = "EXPORTS_STORAGE"
+const STORAGE_CLASS = "STORAGE_CLASS"
+const EXPORTS_TRANSITION_DAYS = "EXPORTS_TRANSITION_DAYS"
+const EXPORTS_TRANSITION_CLASS = "EXPORTS_TRANSITION_CLASS"
+const EXPORTS_EXPIRATION_DAYS = "EXPORTS_EXPIRATION_DAYS"
+const EXPORTS_PREFIX = "EXPORTS_PREFIX"
+const EXPORT_FORMAT = "EXPORT_FORMAT"
 
 const IMAP_URL = "IMAP_URL"
 const IMAP_USER = "IMAP_USER"
 const IMAP_PASS = "IMAP_PASS"
+const IMAP_READ_ONLY = "IMAP_READ_ONLY"
+const IMAP_AUTHZID = "IMAP_AUTHZID"
+const IMAP_OAUTH2_CLIENT_ID = "IMAP_OAUTH2_CLIENT_ID"
+const IMAP_OAUTH2_CLIENT_SECRET = "IMAP_OAUTH2_CLIENT_SECRET"
+const IMAP_OAUTH2_REFRESH_TOKEN = "IMAP_OAUTH2_REFRESH_TOKEN"
+const IMAP_OAUTH2_TOKEN_URL = "IMAP_OAUTH2_TOKEN_URL"
+const IMAP_TRACE = "IMAP_TRACE"
+const IMAP_CONNECT_TIMEOUT = "IMAP_CONNECT_TIMEOUT"
+const IMAP_COMMAND_TIMEOUT = "IMAP_COMMAND_TIMEOUT"
+const IMAP_SEARCH_TIMEOUT = "IMAP_SEARCH_TIMEOUT"
+const IMAP_FETCH_TIMEOUT = "IMAP_FETCH_TIMEOUT"
+
+const REDACT_PII = "REDACT_PII"
+
+const PROTECTED_FLAGS = "PROTECTED_FLAGS"
+
+const SUBSCRIBED_ONLY = "SUBSCRIBED_ONLY"
+
+const TIMEZONE = "TIMEZONE"
+
+const QUARANTINE_FOLDER = "QUARANTINE_FOLDER"
+const QUARANTINE_DAYS = "QUARANTINE_DAYS"
+
+const WEBSERVER_PRODUCTION = "WEBSERVER_PRODUCTION"
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	imap "aaronromeo.com/postmanpat/pkg/models/imapmanager"
+	"aaronromeo.com/postmanpat/pkg/utils"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	goimap "github.com/emersion/go-imap"
+	"github.com/pkg/errors"
+)
+
+// requireEnv checks the environment variables a command depends on are set
+func requireEnv(keys ...string) error {
+	for _, key := range keys {
+		if os.Getenv(key) == "" {
+			return errors.Errorf("environment variable %s is not set", key)
+		}
+	}
+	return nil
+}
+
+// envBool reads a boolean environment variable, unset means false
+func envBool(key string) (bool, error) {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Errorf("invalid value for %s: %+v", key, err)
+	}
+	return b, nil
+}
+
+// imapAuth picks OAuth2 when a refresh token is configured, otherwise the password
+func imapAuth(ctx context.Context) (imap.ImapManagerOption, error) {
+	if os.Getenv(IMAP_OAUTH2_REFRESH_TOKEN) == "" {
+		if err := requireEnv(IMAP_URL, IMAP_USER, IMAP_PASS); err != nil {
+			return nil, err
+		}
+		return imap.WithAuth(os.Getenv(IMAP_USER), os.Getenv(IMAP_PASS)), nil
+	}
+
+	if err := requireEnv(IMAP_URL, IMAP_USER, IMAP_OAUTH2_CLIENT_ID, IMAP_OAUTH2_TOKEN_URL); err != nil {
+		return nil, err
+	}
+	tokenSource := imap.NewRefreshTokenSource(
+		ctx,
+		os.Getenv(IMAP_OAUTH2_CLIENT_ID),
+		os.Getenv(IMAP_OAUTH2_CLIENT_SECRET),
+		os.Getenv(IMAP_OAUTH2_REFRESH_TOKEN),
+		os.Getenv(IMAP_OAUTH2_TOKEN_URL),
+	)
+	return imap.WithOAuth2(os.Getenv(IMAP_USER), tokenSource), nil
+}
+
+// newImapManager connects to the IMAP server configured in the environment
+func newImapManager(ctx context.Context, logger *slog.Logger) (*imap.ImapManagerImpl, error) {
+	auth, err := imapAuth(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	readOnly, err := envBool(IMAP_READ_ONLY)
+	if err != nil {
+		return nil, err
+	}
+
+	trace, err := envBool(IMAP_TRACE)
+	if err != nil {
+		return nil, err
+	}
+
+	redactMode, err := utils.ParseRedactMode(os.Getenv(REDACT_PII))
+	if err != nil {
+		return nil, errors.Errorf("invalid value for %s: %+v", REDACT_PII, err)
+	}
+
+	location, err := loadLocation()
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts, err := loadTimeouts()
+	if err != nil {
+		return nil, err
+	}
+
+	isi, err := imap.NewImapManager(
+		// Connect to server
+		imap.WithTLSConfig(os.Getenv(IMAP_URL), nil),
+		auth,
+		imap.WithAuthorizationIdentity(os.Getenv(IMAP_AUTHZID)),
+		imap.WithReadOnly(readOnly),
+		imap.WithTrace(trace),
+		imap.WithRedactor(utils.Redactor{Mode: redactMode}),
+		imap.WithProtectedFlags(protectedFlags()),
+		imap.WithLocation(location),
+		imap.WithTimeouts(timeouts),
+		imap.WithCtx(ctx),
+		imap.WithLogger(logger),
+		imap.WithFileManager(utils.OSFileManager{}), // TODO: What is this used for?
+	)
+	if err != nil {
+		return nil, errors.Errorf("connecting to the IMAP server error %+v", err)
+	}
+
+	return isi, nil
+}
+
+// protectedFlags lists the flags and keywords which keep a message from being reaped, starred
+// messages are protected unless the setting says otherwise
+func protectedFlags() []string {
+	value, ok := os.LookupEnv(PROTECTED_FLAGS)
+	if !ok {
+		return []string{goimap.FlaggedFlag}
+	}
+
+	flags := []string{}
+	for _, flag := range strings.Split(value, ",") {
+		if flag = strings.TrimSpace(flag); flag != "" {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+// loadTimeouts reads the IMAP timeouts, each falls back to its default when unset
+func loadTimeouts() (imap.Timeouts, error) {
+	timeouts := imap.DefaultTimeouts
+	for key, timeout := range map[string]*time.Duration{
+		IMAP_CONNECT_TIMEOUT: &timeouts.Connect,
+		IMAP_COMMAND_TIMEOUT: &timeouts.Command,
+		IMAP_SEARCH_TIMEOUT:  &timeouts.Search,
+		IMAP_FETCH_TIMEOUT:   &timeouts.Fetch,
+	} {
+		val, ok := os.LookupEnv(key)
+		if !ok || val == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return timeouts, errors.Errorf("invalid value for %s: %+v", key, err)
+		}
+		*timeout = d
+	}
+	return timeouts, nil
+}
+
+// loadLocation is the configured timezone, falling back to the system's
+func loadLocation() (*time.Location, error) {
+	name := os.Getenv(TIMEZONE)
+	if name == "" {
+		return time.Local, nil
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.Errorf("invalid value for %s: %+v", TIMEZONE, err)
+	}
+	return location, nil
+}
+
+// newFileManager connects to the storage bucket configured in the environment, creating
+// the bucket when it doesn't exist yet
+func newFileManager(folder string) (utils.FileManager, error) {
+	fileMgr, err := newS3FileManager(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the bucket exists
+	exists, err := fileMgr.BucketExists(STORAGE_BUCKET)
+	if err != nil {
+		return nil, errors.Errorf("failed to check if bucket exists: %+v", err)
+	}
+
+	if exists {
+		log.Printf("Found bucket %s\n", STORAGE_BUCKET)
+	} else {
+		// Create the bucket if it doesn't exist
+		err = fileMgr.CreateBucket(STORAGE_BUCKET)
+		if err != nil {
+			return nil, errors.Errorf("failed to create bucket: %+v", err)
+		}
+		log.Printf("Created the bucket %s\n", STORAGE_BUCKET)
+	}
+
+	return utils.NewInstrumentedFileManager(fileMgr, "s3"), nil
+}
+
+// newExportsFileManager is where exported messages are written. By default that is the local
+// disk, with EXPORTS_STORAGE set to "bucket" they go to the storage bucket in the configured
+// storage class, while state files are written by newFileManager in the bucket's default so they
+// stay cheap to rewrite and quick to read. The bucket must already exist. Unless it's a dry run,
+// the lifecycle of the exports folder in the bucket is brought up to date with the settings.
+func newExportsFileManager(folder string, dryRun bool) (utils.FileManager, error) {
+	switch exportsStorage := os.Getenv(EXPORTS_STORAGE); exportsStorage {
+	case "", "local":
+		return utils.NewInstrumentedFileManager(utils.OSFileManager{}, "os"), nil
+	case "bucket":
+	default:
+		return nil, errors.Errorf("invalid value for %s: %q, use \"local\" or \"bucket\"", EXPORTS_STORAGE, exportsStorage)
+	}
+
+	fileMgr, err := newS3FileManager(folder, utils.WithStorageClass(os.Getenv(STORAGE_CLASS)))
+	if err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		if err := applyExportsLifecycle(fileMgr); err != nil {
+			return nil, err
+		}
+	}
+
+	return utils.NewInstrumentedFileManager(fileMgr, "s3"), nil
+}
+
+// applyExportsLifecycle moves the account's exports to a colder storage class and expires them as
+// configured. Nothing is changed on the bucket unless one of the settings is present, so a lifecycle
+// managed by hand is left alone.
+func applyExportsLifecycle(fileMgr *utils.S3FileManager) error {
+	_, hasTransition := os.LookupEnv(EXPORTS_TRANSITION_DAYS)
+	_, hasExpiration := os.LookupEnv(EXPORTS_EXPIRATION_DAYS)
+	if !hasTransition && !hasExpiration {
+		return nil
+	}
+
+	rule := utils.LifecycleRule{
+		Folder:                 base.ExportsFolder,
+		TransitionStorageClass: os.Getenv(EXPORTS_TRANSITION_CLASS),
+	}
+	for key, days := range map[string]*int64{
+		EXPORTS_TRANSITION_DAYS: &rule.TransitionDays,
+		EXPORTS_EXPIRATION_DAYS: &rule.ExpirationDays,
+	} {
+		val := os.Getenv(key)
+		if val == "" {
+			continue
+		}
+		d, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return errors.Errorf("invalid value for %s: %+v", key, err)
+		}
+		*days = d
+	}
+
+	if err := fileMgr.PutLifecycleRule(rule); err != nil {
+		return errors.Errorf("failed to set the exports lifecycle: %+v", err)
+	}
+	return nil
+}
+
+// newS3FileManager creates a file manager for the storage configured in the environment
+// without touching the bucket
+func newS3FileManager(folder string, opts ...utils.S3FileManagerOption) (*utils.S3FileManager, error) {
+	if err := requireEnv(DIGITALOCEAN_BUCKET_ACCESS_KEY, DIGITALOCEAN_BUCKET_SECRET_KEY); err != nil {
+		return nil, err
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:   aws.String("nyc3"),
+		Endpoint: aws.String("nyc3.digitaloceanspaces.com"),
+		Credentials: credentials.NewStaticCredentials(
+			os.Getenv(DIGITALOCEAN_BUCKET_ACCESS_KEY),
+			os.Getenv(DIGITALOCEAN_BUCKET_SECRET_KEY),
+			"",
+		),
+	})
+	if err != nil {
+		return nil, errors.Errorf("failed to create AWS session: %+v", err)
+	}
+
+	return utils.NewS3FileManager(sess, STORAGE_BUCKET, folder, opts...), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const doctorDialTimeout = 10 * time.Second
+
+// doctorCapabilities are the server capabilities worth knowing about, with what happens without them
+var doctorCapabilities = []struct {
+	name string
+	hint string
+}{
+	{name: "IDLE", hint: "new mail can only be noticed by polling"},
+	{name: "MOVE", hint: "moves fall back to COPY, STORE \\Deleted and EXPUNGE"},
+	{name: "UIDPLUS", hint: "EXPUNGE can't be limited to specific UIDs"},
+	{name: "CONDSTORE", hint: "flag changes can't be synced incrementally"},
+	{name: "QUOTA", hint: "mailbox usage can't be reported"},
+	{name: "SPECIAL-USE", hint: "Trash, Junk and Archive folders must be named explicitly"},
+}
+
+// doctorReport prints the outcome of each check and remembers whether any failed
+type doctorReport struct {
+	writer io.Writer
+	failed bool
+}
+
+func (r *doctorReport) ok(check, format string, args ...any) {
+	fmt.Fprintf(r.writer, "[ok]   %-12s %s\n", check, fmt.Sprintf(format, args...)) //nolint:errcheck
+}
+
+func (r *doctorReport) warn(check, format string, args ...any) {
+	fmt.Fprintf(r.writer, "[warn] %-12s %s\n", check, fmt.Sprintf(format, args...)) //nolint:errcheck
+}
+
+func (r *doctorReport) fail(check string, err error, hint string) {
+	r.failed = true
+	fmt.Fprintf(r.writer, "[fail] %-12s %v\n", check, err)     //nolint:errcheck
+	fmt.Fprintf(r.writer, "       %-12s hint: %s\n", "", hint) //nolint:errcheck
+}
+
+func doctor(ctx context.Context, logger *slog.Logger) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		_, span := tracer.Start(ctx, "doctor")
+		defer span.End()
+
+		report := &doctorReport{writer: c.App.Writer}
+		diagnoseImap(ctx, logger, report, c.String("mailbox"))
+		diagnoseStorage(report)
+
+		if report.failed {
+			return errors.New("doctor found problems, see the hints above")
+		}
+		return nil
+	}
+}
+
+func diagnoseImap(ctx context.Context, logger *slog.Logger, report *doctorReport, mailboxName string) {
+	if _, err := imapAuth(ctx); err != nil {
+		report.fail("config", err, "run `postmanpat init` or set the IMAP_* variables in .env")
+		return
+	}
+	report.ok("config", "IMAP settings found for %s", os.Getenv(IMAP_USER))
+
+	address := os.Getenv(IMAP_URL)
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		report.fail("config", err, "IMAP_URL must be host:port, e.g. imap.gmail.com:993")
+		return
+	}
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		report.fail("dns", err, fmt.Sprintf("check the spelling of %s and your DNS resolver", host))
+		return
+	}
+	report.ok("dns", "%s resolves to %s", host, strings.Join(addrs, ", "))
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: doctorDialTimeout}, "tcp", address, nil)
+	if err != nil {
+		report.fail("tls", err, "the server must accept implicit TLS, which is usually port 993")
+		return
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	conn.Close() //nolint:errcheck
+	if len(certs) > 0 {
+		expiresIn := time.Until(certs[0].NotAfter)
+		if expiresIn < 14*24*time.Hour {
+			report.warn("tls", "certificate for %s expires %s", host, certs[0].NotAfter.Format(time.RFC3339))
+		} else {
+			report.ok("tls", "certificate for %s valid until %s", host, certs[0].NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	isi, err := newImapManager(ctx, logger)
+	if err != nil {
+		report.fail("login", err, "the server accepted TLS but not an IMAP session, check IMAP_URL")
+		return
+	}
+	if _, err := isi.Login(); err != nil {
+		report.fail("login", err, "check IMAP_USER and IMAP_PASS or the IMAP_OAUTH2_* settings, providers such as Gmail require an app password or OAuth2")
+		return
+	}
+	defer isi.LogoutFn()()
+	report.ok("login", "logged in as %s", isi.Username)
+
+	capabilities, err := isi.Capabilities()
+	if err != nil {
+		report.fail("capability", err, "the server didn't answer CAPABILITY, it may not be an IMAP4rev1 server")
+	} else {
+		for _, capability := range doctorCapabilities {
+			if capabilities[capability.name] {
+				report.ok("capability", "%s supported", capability.name)
+			} else {
+				report.warn("capability", "%s not supported, %s", capability.name, capability.hint)
+			}
+		}
+	}
+
+	result, err := isi.Probe(mailboxName)
+	if err != nil {
+		report.fail("latency", err, fmt.Sprintf("check %s exists, or pick another with --mailbox", mailboxName))
+		return
+	}
+	report.ok("latency", "%s has %d messages, search took %s, fetch took %s", mailboxName, result.Messages, result.SearchLatency, result.FetchLatency)
+}
+
+func diagnoseStorage(report *doctorReport) {
+	fileMgr, err := newS3FileManager(os.Getenv(IMAP_USER))
+	if err != nil {
+		report.fail("storage", err, "set the DIGITALOCEAN_BUCKET_* variables, they are needed to export and to serve the mailbox list")
+		return
+	}
+
+	exists, err := fileMgr.BucketExists(STORAGE_BUCKET)
+	if err != nil {
+		report.fail("storage", err, "check the DIGITALOCEAN_BUCKET_* keys are valid and allowed to list buckets")
+		return
+	}
+	if !exists {
+		report.warn("storage", "bucket %s doesn't exist yet, it is created on first use", STORAGE_BUCKET)
+		return
+	}
+	report.ok("storage", "bucket %s found", STORAGE_BUCKET)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+func renameFolder(ctx context.Context, logger *slog.Logger) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		_, span := tracer.Start(ctx, "renameFolder")
+		defer span.End()
+
+		if c.NArg() != 2 {
+			return errors.New("requires the existing and the new mailbox names")
+		}
+		newName := c.Args().Get(1)
+
+		// Storage is keyed by the IMAP username
+		if err := requireEnv(IMAP_USER); err != nil {
+			return err
+		}
+
+		fileMgr, err := newFileManager(os.Getenv(IMAP_USER))
+		if err != nil {
+			return err
+		}
+
+		runCtx, release, err := acquireLease(ctx, c, logger, fileMgr)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		isi, err := newImapManager(runCtx, logger)
+		if err != nil {
+			return err
+		}
+
+		existingName, err := isi.ServerMailboxName(c.Args().Get(0))
+		if err != nil {
+			return errors.Errorf("listing mailboxes error %+v", err)
+		}
+
+		// Read the mailbox list up front so a bad list doesn't leave the server and the list out of step
+		serializedMailboxes, err := readMailboxList(fileMgr)
+		if err != nil {
+			return err
+		}
+		if storedName, ok := base.FindMailboxName(serializedMailboxes, newName); ok {
+			return errors.Errorf("mailbox list already has settings for %s", storedName)
+		}
+
+		if c.Bool("dry-run") {
+			fmt.Fprintf(c.App.Writer, "Dry run, would rename %s to %s\n", existingName, newName) //nolint:errcheck
+			return nil
+		}
+
+		if err := isi.RenameMailbox(existingName, newName); err != nil {
+			return errors.Errorf("renaming %s error %+v", existingName, err)
+		}
+
+		if storedName, ok := base.FindMailboxName(serializedMailboxes, existingName); ok {
+			serializedMailbox := serializedMailboxes[storedName]
+			delete(serializedMailboxes, storedName)
+			serializedMailbox.Name = newName
+			serializedMailboxes[newName] = serializedMailbox
+		}
+
+		if err := writeMailboxList(fileMgr, serializedMailboxes); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.Writer, "Renamed %s to %s\n", existingName, newName) //nolint:errcheck
+
+		return nil
+	}
+}
+
+func mergeFolders(ctx context.Context, logger *slog.Logger) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		_, span := tracer.Start(ctx, "mergeFolders")
+		defer span.End()
+
+		if c.NArg() != 2 {
+			return errors.New("requires the source and the destination mailbox names")
+		}
+
+		// Storage is keyed by the IMAP username
+		if err := requireEnv(IMAP_USER); err != nil {
+			return err
+		}
+
+		fileMgr, err := newFileManager(os.Getenv(IMAP_USER))
+		if err != nil {
+			return err
+		}
+
+		runCtx, release, err := acquireLease(ctx, c, logger, fileMgr)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		isi, err := newImapManager(runCtx, logger)
+		if err != nil {
+			return err
+		}
+
+		sourceName, err := isi.ServerMailboxName(c.Args().Get(0))
+		if err != nil {
+			return errors.Errorf("listing mailboxes error %+v", err)
+		}
+		destName, err := isi.ServerMailboxName(c.Args().Get(1))
+		if err != nil {
+			return errors.Errorf("listing mailboxes error %+v", err)
+		}
+		// Moving a mailbox's messages into itself would only expunge them from it
+		if base.NormalizeMailboxName(sourceName) == base.NormalizeMailboxName(destName) {
+			return errors.Errorf("%s can't be merged into itself", sourceName)
+		}
+
+		serializedMailboxes, err := readMailboxList(fileMgr)
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("dry-run") {
+			fmt.Fprintf(c.App.Writer, "Dry run, would move every message from %s to %s\n", sourceName, destName) //nolint:errcheck
+			return nil
+		}
+
+		moved, err := isi.MergeMailbox(sourceName, destName)
+		if err != nil {
+			return errors.Errorf("merging %s into %s error %+v", sourceName, destName, err)
+		}
+
+		// The destination keeps its own settings, it only inherits the source's when it has none.
+		// The list is only written, and backed up, when it changes.
+		if storedName, ok := base.FindMailboxName(serializedMailboxes, sourceName); ok {
+			if _, ok := base.FindMailboxName(serializedMailboxes, destName); !ok {
+				serializedMailbox := serializedMailboxes[storedName]
+				serializedMailbox.Name = destName
+				serializedMailboxes[destName] = serializedMailbox
+
+				if err := writeMailboxList(fileMgr, serializedMailboxes); err != nil {
+					return err
+				}
+			}
+		}
+		fmt.Fprintf(c.App.Writer, "Moved %d messages from %s to %s\n", moved, sourceName, destName) //nolint:errcheck
+
+		return nil
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+const envFileTemplate = `# Generated by postmanpat init
+IMAP_URL=%q
+IMAP_USER=%q
+IMAP_PASS=%q
+
+# Log in with OAuth2 (XOAUTH2) instead of IMAP_PASS, e.g. for Gmail or Office 365. The token URL is
+# https://oauth2.googleapis.com/token for Gmail or https://login.microsoftonline.com/common/oauth2/v2.0/token for Office 365
+# IMAP_OAUTH2_CLIENT_ID=""
+# IMAP_OAUTH2_CLIENT_SECRET=""
+# IMAP_OAUTH2_REFRESH_TOKEN=""
+# IMAP_OAUTH2_TOKEN_URL="https://oauth2.googleapis.com/token"
+
+# Act as another user once logged in, to clean a shared or delegated mailbox (needs AUTHENTICATE PLAIN)
+# IMAP_AUTHZID="team@example.com"
+
+# Open mailboxes with EXAMINE and refuse STORE/EXPUNGE
+# IMAP_READ_ONLY="true"
+
+# Hide subjects, addresses and bodies in logs and reports: "hash" or "truncate"
+# REDACT_PII="hash"
+
+# Flags and keywords which keep a message from being reaped, starred messages are protected by default
+# PROTECTED_FLAGS='\Flagged,$NotJunk'
+
+# Move reaped messages to this folder instead of deleting them, "postmanpat sweep" deletes them once their days are up.
+# Leave it blank to delete reaped messages straight away.
+QUARANTINE_FOLDER=%q
+# QUARANTINE_DAYS="14"
+
+# Storage for exports and the mailbox list, required by mailboxnames, reapmessages and webserver
+DIGITALOCEAN_BUCKET_ACCESS_KEY=%q
+DIGITALOCEAN_BUCKET_SECRET_KEY=%q
+
+# Export to the storage bucket instead of the local disk
+# EXPORTS_STORAGE="bucket"
+
+# Storage class for exported messages in the bucket, e.g. "STANDARD_IA", defaults to the bucket's
+# STORAGE_CLASS="STANDARD_IA"
+
+# Move exports in the bucket to a colder storage class after some days, and delete them after more days
+# EXPORTS_TRANSITION_DAYS="30"
+# EXPORTS_TRANSITION_CLASS="GLACIER"
+# EXPORTS_EXPIRATION_DAYS="365"
+
+# Group exports by account, day or run, using {account}, {date} and {run}. Each run is recorded in workingfiles/runs.
+# EXPORTS_PREFIX="{account}/{date}/{run}"
+
+# Export a folder per message ("parts"), an mbox file per mailbox ("mbox") or a Maildir per mailbox ("maildir")
+# EXPORT_FORMAT="mbox"
+
+# IANA timezone whose calendar days mailbox lifespans are counted in, defaults to the system timezone
+# TIMEZONE="America/Toronto"
+
+# Telemetry exporter: "none", "stdout", "otlp" or "uptrace"
+# OTEL_EXPORTER="stdout"
+`
+
+const cronEntry = "0 */12 * * * %s reapmessages\n"
+
+// defaultQuarantineFolder is the folder init creates for quarantine when none is configured
+const defaultQuarantineFolder = "PostmanPat/Quarantine"
+
+func initConfig(ctx context.Context, logger *slog.Logger) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		_, span := tracer.Start(ctx, "initConfig")
+		defer span.End()
+
+		envFile := c.String("env-file")
+		if _, err := os.Stat(envFile); err == nil && !c.Bool("force") {
+			return errors.Errorf("%s already exists, use --force to overwrite it", envFile)
+		}
+
+		reader := bufio.NewReader(c.App.Reader)
+		values := map[string]string{}
+		for _, setting := range []struct {
+			key    string
+			secret bool
+		}{
+			{key: IMAP_URL},
+			{key: IMAP_USER},
+			{key: IMAP_PASS, secret: true},
+			{key: DIGITALOCEAN_BUCKET_ACCESS_KEY},
+			{key: DIGITALOCEAN_BUCKET_SECRET_KEY, secret: true},
+		} {
+			key := setting.key
+			value, err := prompt(reader, c.App.Reader, c.App.Writer, key, os.Getenv(key), setting.secret)
+			if err != nil {
+				return errors.Errorf("reading %s error %+v", key, err)
+			}
+			if err := os.Setenv(key, value); err != nil {
+				return errors.Errorf("setting %s error %+v", key, err)
+			}
+			values[key] = value
+		}
+
+		// Verify the login before writing anything
+		isi, err := newImapManager(ctx, logger)
+		if err != nil {
+			return err
+		}
+		if _, err := isi.Login(); err != nil {
+			return errors.Errorf("verifying IMAP login error %+v", err)
+		}
+		isi.LogoutFn()()
+		fmt.Fprintf(c.App.Writer, "Logged in to %s as %s\n", values[IMAP_URL], values[IMAP_USER]) //nolint:errcheck
+
+		quarantineFolder := os.Getenv(QUARANTINE_FOLDER)
+		if quarantineFolder == "" {
+			quarantineFolder = defaultQuarantineFolder
+		}
+		created, err := isi.CreateMailbox(quarantineFolder)
+		if err != nil {
+			return errors.Errorf("creating the quarantine folder %s error %+v", quarantineFolder, err)
+		}
+		if created {
+			fmt.Fprintf(c.App.Writer, "Created the quarantine folder %s\n", quarantineFolder) //nolint:errcheck
+		}
+
+		envContents := fmt.Sprintf(
+			envFileTemplate,
+			values[IMAP_URL],
+			values[IMAP_USER],
+			values[IMAP_PASS],
+			quarantineFolder,
+			values[DIGITALOCEAN_BUCKET_ACCESS_KEY],
+			values[DIGITALOCEAN_BUCKET_SECRET_KEY],
+		)
+		if err := os.WriteFile(envFile, []byte(envContents), 0600); err != nil {
+			return errors.Errorf("writing %s error %+v", envFile, err)
+		}
+		fmt.Fprintf(c.App.Writer, "Wrote %s\n", envFile) //nolint:errcheck
+
+		if err := os.MkdirAll(filepath.Dir(base.MailboxListFile), os.ModePerm); err != nil {
+			return errors.Errorf("creating working files folder error %+v", err)
+		}
+
+		if c.Bool("cron") {
+			executable, err := os.Executable()
+			if err != nil {
+				return errors.Errorf("locating the postmanpat binary error %+v", err)
+			}
+			fmt.Fprintln(c.App.Writer, "Add this entry to your crontab to reap messages twice a day:") //nolint:errcheck
+			if timezone := os.Getenv(TIMEZONE); timezone != "" {
+				// cronie and systemd timers run the entries below in this timezone instead of the system's
+				fmt.Fprintf(c.App.Writer, "CRON_TZ=%s\n", timezone) //nolint:errcheck
+			}
+			fmt.Fprintf(c.App.Writer, cronEntry, executable) //nolint:errcheck
+		}
+
+		fmt.Fprintln(c.App.Writer, "Run `postmanpat mailboxnames` to build the mailbox list") //nolint:errcheck
+
+		return nil
+	}
+}
+
+// prompt asks for a value on the writer, falling back to the current value when the answer is blank.
+// Secrets typed at a terminal aren't echoed, input is the reader's source for checking that.
+func prompt(reader *bufio.Reader, input io.Reader, writer io.Writer, key, current string, secret bool) (string, error) {
+	switch {
+	case current != "" && secret:
+		fmt.Fprintf(writer, "%s [keep current]: ", key) //nolint:errcheck
+	case current != "":
+		fmt.Fprintf(writer, "%s [%s]: ", key, current) //nolint:errcheck
+	default:
+		fmt.Fprintf(writer, "%s: ", key) //nolint:errcheck
+	}
+
+	var answer string
+	if file, ok := input.(*os.File); ok && secret && term.IsTerminal(int(file.Fd())) {
+		password, err := term.ReadPassword(int(file.Fd()))
+		// The newline typed to end the secret isn't echoed either
+		fmt.Fprintln(writer) //nolint:errcheck
+		if err != nil {
+			return "", err
+		}
+		answer = string(password)
+	} else {
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		answer = line
+	}
+
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return current, nil
+	}
+	return answer, nil
+}
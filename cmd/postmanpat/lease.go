@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"aaronromeo.com/postmanpat/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// leaseTTL is how long a run that died keeps others off the account, a live run renews its lease
+// every third of it
+const leaseTTL = 10 * time.Minute
+
+// acquireLease keeps other runs from changing the account until release is called. The lease is
+// in the account's storage, so overlapping cron jobs on different hosts back off too, though two
+// runs starting at the same moment can both get it, see utils.Lease.
+// The returned context is cancelled if the lease is lost. A dry run changes nothing, so it runs
+// without a lease.
+func acquireLease(ctx context.Context, c *cli.Context, logger *slog.Logger, fileMgr utils.FileManager) (context.Context, func(), error) {
+	if c.Bool("dry-run") {
+		return ctx, func() {}, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	holder := fmt.Sprintf("%s:%d", hostname, os.Getpid())
+
+	lease, err := utils.AcquireLease(fileMgr, base.LeaseFile, holder, leaseTTL)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "another run is changing this account, try again once it finishes")
+	}
+
+	leaseCtx, stop := lease.KeepRenewed(ctx, logger)
+	release := func() {
+		stop()
+		if err := lease.Release(); err != nil {
+			logger.ErrorContext(ctx, "Failed to release the lease", slog.Any("error", utils.WrapError(err)))
+		}
+	}
+	return leaseCtx, release, nil
+}
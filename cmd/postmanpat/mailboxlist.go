@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"aaronromeo.com/postmanpat/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// backupTimestampFormat names backups so they sort by when they were taken
+const backupTimestampFormat = "20060102T150405Z"
+
+// readMailboxList reads the mailbox settings written by mailboxnames
+func readMailboxList(fileMgr utils.FileManager) (map[string]base.SerializedMailbox, error) {
+	data, err := fileMgr.ReadFile(base.MailboxListFile)
+	if err != nil {
+		return nil, errors.Errorf("reading mailbox list error %+v", err)
+	}
+
+	return decodeMailboxList(data)
+}
+
+// readMailboxListIfExists is readMailboxList, with no list yet read as an empty one
+func readMailboxListIfExists(fileMgr utils.FileManager) (map[string]base.SerializedMailbox, error) {
+	data, err := fileMgr.ReadFile(base.MailboxListFile)
+	if utils.IsNotExist(err) {
+		return map[string]base.SerializedMailbox{}, nil
+	}
+	if err != nil {
+		return nil, errors.Errorf("reading mailbox list error %+v", err)
+	}
+
+	return decodeMailboxList(data)
+}
+
+func decodeMailboxList(data []byte) (map[string]base.SerializedMailbox, error) {
+	storedMailboxes := make(map[string]base.SerializedMailbox)
+	if err := json.Unmarshal(data, &storedMailboxes); err != nil {
+		return nil, errors.Errorf("unable to unmarshal mailboxes %+v", err)
+	}
+
+	// Entries are keyed by the name the server lists, which is the name sent with commands. Use
+	// base.FindMailboxName to look up a name given in another form.
+	for name, serializedMailbox := range storedMailboxes {
+		serializedMailbox.Name = name
+		storedMailboxes[name] = serializedMailbox
+	}
+
+	return storedMailboxes, nil
+}
+
+// writeMailboxList replaces the mailbox settings in storage, backing up the current list first
+func writeMailboxList(fileMgr utils.FileManager, serializedMailboxes map[string]base.SerializedMailbox) error {
+	encodedMailboxes, err := json.MarshalIndent(serializedMailboxes, "", "  ")
+	if err != nil {
+		return errors.Errorf("converting mailbox names to JSON error %+v", err)
+	}
+
+	return replaceMailboxList(fileMgr, encodedMailboxes)
+}
+
+// replaceMailboxList backs up the current mailbox list, then writes the new one as is
+func replaceMailboxList(fileMgr utils.FileManager, encodedMailboxes []byte) error {
+	if _, err := backupMailboxList(fileMgr, time.Now()); err != nil {
+		return err
+	}
+
+	if err := fileMgr.WriteFile(base.MailboxListFile, encodedMailboxes, 0644); err != nil {
+		return errors.Errorf("writing mailbox names file error %+v", err)
+	}
+
+	return nil
+}
+
+// mailboxListBackupFile is where the mailbox list is copied to before a change made at the timestamp
+func mailboxListBackupFile(timestamp string) string {
+	return path.Join(base.BackupsFolder, fmt.Sprintf("mailboxlist-%s.json", timestamp))
+}
+
+// backupMailboxList streams the current mailbox list, byte for byte, to a timestamped backup and
+// returns the timestamp. Nothing is written when there is no list yet.
+func backupMailboxList(fileMgr utils.FileManager, now time.Time) (string, error) {
+	reader, err := fileMgr.Open(base.MailboxListFile)
+	if utils.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Errorf("reading mailbox list for backup error %+v", err)
+	}
+	defer reader.Close() //nolint:errcheck
+
+	timestamp := now.UTC().Format(backupTimestampFormat)
+	if err := fileMgr.MkdirAll(base.BackupsFolder, os.ModePerm); err != nil {
+		return "", errors.Errorf("creating backups folder error %+v", err)
+	}
+	writer, err := fileMgr.Create(mailboxListBackupFile(timestamp))
+	if err != nil {
+		return "", errors.Errorf("writing mailbox list backup error %+v", err)
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		writer.Close() //nolint:errcheck
+		return "", errors.Errorf("writing mailbox list backup error %+v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return "", errors.Errorf("writing mailbox list backup error %+v", err)
+	}
+	log.Printf("Backed up the mailbox list, restore it with `postmanpat config restore %s`\n", timestamp)
+
+	return timestamp, nil
+}
+
+func restoreConfig(ctx context.Context) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		_, span := tracer.Start(ctx, "restoreConfig")
+		defer span.End()
+
+		timestamp := c.Args().First()
+		if _, err := time.Parse(backupTimestampFormat, timestamp); err != nil {
+			return errors.Errorf("requires a backup timestamp such as %s", time.Now().UTC().Format(backupTimestampFormat))
+		}
+
+		// Storage is keyed by the IMAP username
+		if err := requireEnv(IMAP_USER); err != nil {
+			return err
+		}
+
+		fileMgr, err := newFileManager(os.Getenv(IMAP_USER))
+		if err != nil {
+			return err
+		}
+
+		data, err := fileMgr.ReadFile(mailboxListBackupFile(timestamp))
+		if err != nil {
+			return errors.Errorf("reading backup %s error %+v", timestamp, err)
+		}
+
+		// Don't restore a backup that reapmessages couldn't read
+		if err := json.Unmarshal(data, &map[string]base.SerializedMailbox{}); err != nil {
+			return errors.Errorf("backup %s is not a valid mailbox list %+v", timestamp, err)
+		}
+
+		if c.Bool("dry-run") {
+			fmt.Fprintf(c.App.Writer, "Dry run, would restore the mailbox list from %s\n", timestamp) //nolint:errcheck
+			return nil
+		}
+
+		if err := replaceMailboxList(fileMgr, data); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.Writer, "Restored the mailbox list from %s\n", timestamp) //nolint:errcheck
+
+		return nil
+	}
+}
@@ -8,16 +8,17 @@ import (
 	"log"
 	"log/slog"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"syscall"
+	"time"
+
+	// Embed the timezone database so TIMEZONE works in images without tzdata
+	_ "time/tzdata"
 
 	"aaronromeo.com/postmanpat/handlers"
 	"aaronromeo.com/postmanpat/pkg/base"
-	imap "aaronromeo.com/postmanpat/pkg/models/imapmanager"
 	"aaronromeo.com/postmanpat/pkg/models/mailbox"
 	"aaronromeo.com/postmanpat/pkg/utils"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 
 	// "github.com/gofiber/fiber/v3"
 	"github.com/joho/godotenv"
@@ -25,6 +26,7 @@ import (
 
 	otelfiber "github.com/gofiber/contrib/otelfiber/v2"
 	fiber "github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/compress"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/gofiber/template/html/v2"
@@ -57,48 +59,30 @@ func main() {
 		IMAP_PASS,
 	} {
 		if _, ok := os.LookupEnv(key); !ok {
-			err := os.Setenv(key, os.Getenv(fmt.Sprintf("%s%s", TF_VAR_PREFIX, key)))
+			tfKey := fmt.Sprintf("%s%s", TF_VAR_PREFIX, key)
+			if _, ok := os.LookupEnv(tfKey); !ok {
+				continue
+			}
+			err := os.Setenv(key, os.Getenv(tfKey))
 			if err != nil {
 				log.Printf("Error unable to set the env var: %s %s", key, err)
 			}
 		}
 	}
 
-	for _, key := range []string{
-		DIGITALOCEAN_BUCKET_ACCESS_KEY,
-		DIGITALOCEAN_BUCKET_SECRET_KEY,
-		IMAP_URL,
-		IMAP_USER,
-		IMAP_PASS,
-		base.UPTRACE_DSN_ENV_VAR,
-	} {
-		if _, ok := os.LookupEnv(key); !ok {
-			log.Fatalf("Environment variable %s is not set\n", key)
-		} else {
-			log.Printf("Environment variable %s is set\n", key)
-		}
-	}
-
-	sess, err := session.NewSession(&aws.Config{
-		Region:   aws.String("nyc3"),
-		Endpoint: aws.String("nyc3.digitaloceanspaces.com"),
-		Credentials: credentials.NewStaticCredentials(
-			os.Getenv(DIGITALOCEAN_BUCKET_ACCESS_KEY),
-			os.Getenv(DIGITALOCEAN_BUCKET_SECRET_KEY),
-			"",
-		),
-	})
-	if err != nil {
-		log.Fatalf("Failed to create AWS session: %v", err)
-	}
-
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
-	ctx := context.Background()
+	// Ctrl-C and SIGTERM cancel the context, so long exports stop before deleting anything more
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Set up OpenTelemetry.
-	otelShutdown, err := utils.SetupOTelSDK(ctx)
+	otelExporter, err := utils.ParseOTelExporter(os.Getenv(base.OTEL_EXPORTER_ENV))
 	if err != nil {
-		return
+		log.Fatalf("Invalid value for %s: %v", base.OTEL_EXPORTER_ENV, err)
+	}
+	otelShutdown, err := utils.SetupOTelSDK(ctx, otelExporter)
+	if err != nil {
+		log.Fatalf("Failed to set up OpenTelemetry: %v", err)
 	}
 	// Handle shutdown properly so nothing leaks.
 	defer func() {
@@ -108,56 +92,170 @@ func main() {
 	_, span := tracer.Start(ctx, base.OTEL_NAME)
 	defer span.End()
 
-	isi, err := imap.NewImapManager(
-		// Connect to server
-		imap.WithTLSConfig(os.Getenv(IMAP_URL), nil),
-		imap.WithAuth(os.Getenv(IMAP_USER), os.Getenv(IMAP_PASS)),
-		imap.WithCtx(ctx),
-		imap.WithLogger(logger),
-		imap.WithFileManager(utils.OSFileManager{}), // TODO: What is this used for?
-	)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	fileMgr := utils.NewS3FileManager(sess, STORAGE_BUCKET, isi.Username)
-
-	// Check if the bucket exists
-	exists, err := fileMgr.BucketExists(STORAGE_BUCKET)
-	if err != nil {
-		log.Fatalf("Failed to check if bucket exists: %v", err)
-	}
-
-	if exists {
-		log.Printf("Found bucket %s\n", STORAGE_BUCKET)
-	} else {
-		// Create the bucket if it doesn't exist
-		err = fileMgr.CreateBucket(STORAGE_BUCKET)
-		if err != nil {
-			log.Fatalf("Failed to create bucket: %v", err)
-		}
-		log.Printf("Created the bucket %s\n", STORAGE_BUCKET)
-	}
-
 	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "trace-imap",
+				Usage:   "Log the IMAP protocol exchange with credentials scrubbed and literals cut short",
+				EnvVars: []string{IMAP_TRACE},
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Report what reapmessages, folders and config restore would change without changing anything",
+			},
+		},
+		Before: func(c *cli.Context) error {
+			// The IMAP manager reads its settings from the environment
+			if c.Bool("trace-imap") {
+				return os.Setenv(IMAP_TRACE, "true")
+			}
+			return nil
+		},
 		Commands: []*cli.Command{
+			{
+				Name:  "init",
+				Usage: "Collect the IMAP and storage settings, verify the login and write a starter .env",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "env-file",
+						Value: ".env",
+						Usage: "Path of the env file to write",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Overwrite an existing env file",
+					},
+					&cli.BoolFlag{
+						Name:  "cron",
+						Usage: "Print a crontab entry which reaps messages twice a day",
+					},
+				},
+				Action: initConfig(ctx, logger),
+			},
+			{
+				Name:  "doctor",
+				Usage: "Check connectivity, credentials and server capabilities",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "mailbox",
+						Value: "INBOX",
+						Usage: "Mailbox used to measure search and fetch latency",
+					},
+				},
+				Action: doctor(ctx, logger),
+			},
 			{
 				Name:    "mailboxnames",
 				Aliases: []string{"mn"},
 				Usage:   "List mailbox names",
-				Action:  listMailboxNames(ctx, isi, fileMgr),
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "subscribed-only",
+						Usage:   "Only add the mailboxes the user is subscribed to, an unsubscribed mailbox keeps any settings it already has",
+						EnvVars: []string{SUBSCRIBED_ONLY},
+					},
+				},
+				Action: listMailboxNames(ctx, logger),
+			},
+			{
+				Name:    "subscriptions",
+				Aliases: []string{"subs"},
+				Usage:   "Manage mailbox subscriptions",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "List the subscribed mailboxes",
+						Action: listSubscriptions(ctx, logger),
+					},
+					{
+						Name:      "subscribe",
+						Usage:     "Subscribe to a mailbox",
+						ArgsUsage: "<mailbox>",
+						Action:    subscribe(ctx, logger),
+					},
+					{
+						Name:      "unsubscribe",
+						Usage:     "Unsubscribe from a mailbox",
+						ArgsUsage: "<mailbox>",
+						Action:    unsubscribe(ctx, logger),
+					},
+				},
+			},
+			{
+				Name:  "folders",
+				Usage: "Reorganize mailboxes and keep the mailbox list in step",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "rename",
+						Usage:     "Rename a mailbox, carrying its settings over to the new name",
+						ArgsUsage: "<existing> <new>",
+						Action:    renameFolder(ctx, logger),
+					},
+					{
+						Name:      "merge",
+						Usage:     "Move every message from one mailbox into another",
+						ArgsUsage: "<source> <destination>",
+						Action:    mergeFolders(ctx, logger),
+					},
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "Manage the mailbox list",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "restore",
+						Usage:     "Roll the mailbox list back to a backup taken before it was changed",
+						ArgsUsage: "<timestamp>",
+						Action:    restoreConfig(ctx),
+					},
+				},
 			},
 			{
 				Name:    "reapmessages",
 				Aliases: []string{"re"},
 				Usage:   "Reap the messages in a mailbox",
-				Action:  reapMessages(ctx, isi, fileMgr),
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "strict",
+						Usage: "Abort on the first message that fails to export instead of skipping it",
+					},
+					&cli.IntFlag{
+						Name:  "batch-size",
+						Value: mailbox.DefaultBatchSize,
+						Usage: "Number of messages fetched by a single FETCH",
+					},
+					&cli.StringFlag{
+						Name:    "format",
+						Value:   string(mailbox.ExportFormatParts),
+						Usage:   "How messages are exported: parts (a folder per message), mbox (a file per mailbox) or maildir",
+						EnvVars: []string{EXPORT_FORMAT},
+					},
+					&cli.BoolFlag{
+						Name:    "subscribed-only",
+						Usage:   "Skip the mailboxes the user isn't subscribed to",
+						EnvVars: []string{SUBSCRIBED_ONLY},
+					},
+				},
+				Action: reapMessages(ctx, logger),
+			},
+			{
+				Name:   "sweep",
+				Usage:  "Delete the messages whose time in the quarantine folder is up",
+				Action: sweepQuarantine(ctx, logger),
 			},
 			{
 				Name:    "webserver",
 				Aliases: []string{"ws"},
 				Usage:   "Start the web server",
-				Action:  webserver(ctx, fileMgr),
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "production",
+						Usage:   "Cache templates and the asset manifest instead of reloading them on every request",
+						EnvVars: []string{WEBSERVER_PRODUCTION},
+					},
+				},
+				Action: webserver(ctx),
 			},
 		},
 	}
@@ -167,11 +265,21 @@ func main() {
 	}
 }
 
-func listMailboxNames(ctx context.Context, isi *imap.ImapManagerImpl, fileMgr utils.FileManager) func(c *cli.Context) error {
+func listMailboxNames(ctx context.Context, logger *slog.Logger) func(c *cli.Context) error {
 	return func(c *cli.Context) error {
 		_, span := tracer.Start(ctx, "listMailboxNames")
 		defer span.End()
 
+		isi, err := newImapManager(ctx, logger)
+		if err != nil {
+			return err
+		}
+
+		fileMgr, err := newFileManager(isi.Username)
+		if err != nil {
+			return err
+		}
+
 		// List mailboxes
 		verifiedMailboxObjs, err := isi.GetMailboxes()
 		if err != nil {
@@ -185,79 +293,243 @@ func listMailboxNames(ctx context.Context, isi *imap.ImapManagerImpl, fileMgr ut
 				Deletable:  mailbox.Deletable,
 				Exportable: mailbox.Exportable,
 				Lifespan:   mailbox.Lifespan,
+				AgeBasis:   mailbox.AgeBasis,
 			}
 		}
 
-		encodedMailboxes, err := json.MarshalIndent(exportedMailboxes, "", "  ")
-		if err != nil {
-			return errors.Errorf("converting mailbox names to JSON error %+v", err)
+		if c.Bool("subscribed-only") {
+			subscribed, err := subscribedMailboxes(isi)
+			if err != nil {
+				return err
+			}
+
+			storedMailboxes, err := readMailboxListIfExists(fileMgr)
+			if err != nil {
+				return err
+			}
+
+			// An unsubscribed mailbox isn't added, but one already in the list keeps its settings so
+			// they are still there if it is subscribed to again. reapmessages --subscribed-only skips it.
+			for name := range exportedMailboxes {
+				if subscribed[name] {
+					continue
+				}
+				if storedName, ok := base.FindMailboxName(storedMailboxes, name); ok {
+					serializedMailbox := storedMailboxes[storedName]
+					serializedMailbox.Name = name
+					exportedMailboxes[name] = serializedMailbox
+				} else {
+					delete(exportedMailboxes, name)
+				}
+			}
 		}
 
 		span.SetAttributes(
 			attribute.String("mailboxListFile.name", base.MailboxListFile),
-			attribute.Int("encodedMailboxes.count", len(encodedMailboxes)),
+			attribute.Int("exportedMailboxes.count", len(exportedMailboxes)),
 		)
-		if err := fileMgr.WriteFile(base.MailboxListFile, encodedMailboxes, 0644); err != nil {
-			return errors.Errorf("writing mailbox names file error %+v", err)
+		if err := writeMailboxList(fileMgr, exportedMailboxes); err != nil {
+			return err
 		}
 
 		return nil
 	}
 }
 
-func reapMessages(ctx context.Context, _ *imap.ImapManagerImpl, fileMgr utils.FileManager) func(c *cli.Context) error {
-	return func(c *cli.Context) error {
+func reapMessages(ctx context.Context, logger *slog.Logger) func(c *cli.Context) error {
+	return func(c *cli.Context) (err error) {
 		_, span := tracer.Start(ctx, "reapMessages")
 		defer span.End()
 
-		// Read the mailbox list file
-		data, err := fileMgr.ReadFile(base.MailboxListFile)
+		// Storage is keyed by the IMAP username
+		if err := requireEnv(IMAP_USER); err != nil {
+			return err
+		}
+
+		fileMgr, err := newFileManager(os.Getenv(IMAP_USER))
+		if err != nil {
+			return err
+		}
+
+		runCtx, release, err := acquireLease(ctx, c, logger, fileMgr)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		record, err := newRunRecord(c, os.Getenv(IMAP_USER))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if writeErr := record.write(fileMgr, err); writeErr != nil {
+				logger.ErrorContext(ctx, "Failed to record the run", slog.Any("error", utils.WrapError(writeErr)))
+			}
+		}()
+		span.SetAttributes(
+			attribute.String("run.id", record.RunID),
+			attribute.String("run.exportFolder", record.ExportFolder),
+		)
+
+		quarantineFolder, quarantineExpiry, err := loadQuarantine()
+		if err != nil {
+			return err
+		}
+
+		dryRun := c.Bool("dry-run")
+		exportsFileMgr, err := newExportsFileManager(os.Getenv(IMAP_USER), dryRun)
 		if err != nil {
-			return errors.Errorf("exporting mailbox error %+v", err)
+			return err
 		}
-		mailboxes := make(map[string]mailbox.MailboxImpl)
 
-		err = json.Unmarshal(data, &mailboxes)
+		isi, err := newImapManager(runCtx, logger)
 		if err != nil {
-			return errors.Errorf("unable to marshal mailboxes %+v", err)
+			return err
 		}
 
-		for _, mailbox := range mailboxes {
-			err := mailbox.ProcessMailbox()
+		if quarantineFolder != "" {
+			quarantineFolder, err = isi.ServerMailboxName(quarantineFolder)
+			if err != nil {
+				return errors.Errorf("listing mailboxes error %+v", err)
+			}
+		}
+
+		// Read the mailbox list file
+		serializedMailboxes, err := readMailboxList(fileMgr)
+		if err != nil {
+			return err
+		}
+
+		var subscribed map[string]bool
+		if c.Bool("subscribed-only") {
+			if subscribed, err = subscribedMailboxes(isi); err != nil {
+				return err
+			}
+		}
+
+		plan := []mailbox.PlannedAction{}
+		exportErrors := []mailbox.MessageError{}
+		for name, serializedMailbox := range serializedMailboxes {
+			if runCtx.Err() != nil {
+				return errors.Wrap(context.Cause(runCtx), "reaping stopped")
+			}
+
+			if subscribed != nil && !subscribed[name] {
+				logger.InfoContext(runCtx, "Skipping unsubscribed mailbox", slog.String("name", name))
+				continue
+			}
+
+			serializedMailbox.Name = name
+			mb, err := isi.Mailbox(
+				serializedMailbox,
+				mailbox.WithStrict(c.Bool("strict")),
+				mailbox.WithDryRun(dryRun),
+				mailbox.WithFileManager(exportsFileMgr),
+				mailbox.WithBatchSize(c.Int("batch-size")),
+				mailbox.WithExportPrefix(record.exportPrefix),
+				mailbox.WithExportFormat(mailbox.ExportFormat(c.String("format"))),
+				mailbox.WithQuarantine(quarantineFolder, quarantineExpiry),
+				mailbox.WithProgress(func(fetched, total int) {
+					fmt.Fprintf(c.App.ErrWriter, "%s: fetched %d of %d messages\n", name, fetched, total) //nolint:errcheck
+				}),
+			)
+			if err != nil {
+				return errors.Errorf("unable to create mailbox %+v", err)
+			}
+
+			err = mb.ProcessMailbox()
+			// Record what was moved to quarantine even when the mailbox failed part way
+			if recordErr := recordQuarantine(fileMgr, mb.Quarantined); recordErr != nil {
+				return recordErr
+			}
 			if err != nil {
 				return errors.Errorf("unable to process mailboxes %+v", err)
 			}
+			exportErrors = append(exportErrors, mb.ExportErrors...)
+			record.ExportErrors = len(exportErrors)
+			plan = append(plan, mb.Plan...)
+		}
+
+		if dryRun {
+			return writeReapPlan(c, fileMgr, plan)
+		}
+
+		span.SetAttributes(attribute.Int("exportErrors.count", len(exportErrors)))
+		if len(exportErrors) > 0 {
+			encodedErrors, err := json.MarshalIndent(exportErrors, "", "  ")
+			if err != nil {
+				return errors.Errorf("converting export errors to JSON error %+v", err)
+			}
+
+			if err := fileMgr.WriteFile(base.ExportErrorsFile, encodedErrors, 0644); err != nil {
+				return errors.Errorf("writing export errors file error %+v", err)
+			}
+			log.Printf("Skipped %d messages which failed to export, see %s\n", len(exportErrors), base.ExportErrorsFile)
 		}
 
 		return nil
 	}
 }
 
-func webserver(ctx context.Context, fileMgr utils.FileManager) func(c *cli.Context) error {
+// writeReapPlan stores the messages a dry run would reap, sorted so plans can be diffed
+func writeReapPlan(c *cli.Context, fileMgr utils.FileManager, plan []mailbox.PlannedAction) error {
+	mailbox.SortPlan(plan)
+	encodedPlan, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return errors.Errorf("converting reap plan to JSON error %+v", err)
+	}
+
+	if err := fileMgr.WriteFile(base.ReapPlanFile, encodedPlan, 0644); err != nil {
+		return errors.Errorf("writing reap plan file error %+v", err)
+	}
+	fmt.Fprintf(c.App.Writer, "Dry run, %d messages would be reaped, see %s\n", len(plan), base.ReapPlanFile) //nolint:errcheck
+
+	return nil
+}
+
+// mailboxListTTL is how long the web server keeps the mailbox list before reading it again
+const mailboxListTTL = 30 * time.Second
+
+func webserver(ctx context.Context) func(c *cli.Context) error {
 	return func(c *cli.Context) error {
 		_, span := tracer.Start(ctx, "webserver")
 		defer span.End()
 
+		// The web server only reads from storage, which is keyed by the IMAP username
+		if err := requireEnv(IMAP_USER); err != nil {
+			return err
+		}
+
+		fileMgr, err := newFileManager(os.Getenv(IMAP_USER))
+		if err != nil {
+			return err
+		}
+
+		// Outside production, edits to templates and assets show up without a restart
+		production := c.Bool("production")
+
+		assets, err := handlers.NewAssetManifest("public/assets")
+		if err != nil {
+			return err
+		}
+
 		// Create view engine
 		engine := html.New("./views", ".html")
+		engine.Reload(!production)
 
-		// Disable this in production
-		engine.Reload(true)
-
-		engine.AddFunc("getCssAsset", func(name string) (res template.HTML) {
-			err := filepath.Walk("public/assets", func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if info.Name() == name {
-					res = template.HTML("<link rel=\"stylesheet\" href=\"/" + path + "\">")
+		// getCssAsset takes the stylesheet's path within public/assets, such as "app.css"
+		engine.AddFunc("getCssAsset", func(relPath string) template.HTML {
+			if !production {
+				if err := assets.Load(); err != nil {
+					log.Printf("unable to load assets %+v", err)
 				}
-				return nil
-			})
-			if err != nil {
-				log.Printf("unable to process mailboxes %+v", err)
 			}
-			return
+			url, ok := assets.URL(relPath)
+			if !ok {
+				log.Printf("unknown asset %s", relPath)
+				return ""
+			}
+			return template.HTML("<link rel=\"stylesheet\" href=\"" + url + "\">")
 		})
 
 		// Create fiber app
@@ -270,9 +542,11 @@ func webserver(ctx context.Context, fileMgr utils.FileManager) func(c *cli.Conte
 		app.Use(recover.New())
 		app.Use(logger.New())
 		app.Use(otelfiber.Middleware())
+		app.Use(compress.New())
 
+		mailboxList := handlers.NewMailboxListCache(fileMgr, mailboxListTTL)
 		app.Use(func(c *fiber.Ctx) error {
-			c.Locals("fileMgr", fileMgr)
+			c.Locals("mailboxList", mailboxList)
 			return c.Next()
 		})
 
@@ -282,6 +556,7 @@ func webserver(ctx context.Context, fileMgr utils.FileManager) func(c *cli.Conte
 		app.Get("/mailboxes", handlers.Mailboxes)
 
 		// Setup static files
+		app.Get(handlers.AssetsPath+"/*", assets.Serve)
 		app.Static("/public", "./public")
 
 		// Handle not founds
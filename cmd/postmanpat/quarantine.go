@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"aaronromeo.com/postmanpat/pkg/models/mailbox"
+	"aaronromeo.com/postmanpat/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// defaultQuarantineDays is how long messages stay in quarantine when QUARANTINE_DAYS is unset
+const defaultQuarantineDays = 14
+
+// loadQuarantine reads the quarantine folder and how long messages stay in it. An unset folder
+// turns quarantine off. The folder is named as configured, resolve it with ServerMailboxName before
+// sending it to the server.
+func loadQuarantine() (string, time.Duration, error) {
+	folder := os.Getenv(QUARANTINE_FOLDER)
+	days := defaultQuarantineDays
+	if val := os.Getenv(QUARANTINE_DAYS); val != "" {
+		d, err := strconv.Atoi(val)
+		if err != nil || d < 1 {
+			return "", 0, errors.Errorf("invalid value for %s: must be a number of days, got %q", QUARANTINE_DAYS, val)
+		}
+		days = d
+	}
+	return folder, time.Duration(days) * 24 * time.Hour, nil
+}
+
+// readQuarantine reads the messages waiting in quarantine, a missing file is an empty quarantine
+func readQuarantine(fileMgr utils.FileManager) ([]mailbox.QuarantinedMessage, error) {
+	quarantined := []mailbox.QuarantinedMessage{}
+	data, err := fileMgr.ReadFile(base.QuarantineFile)
+	if utils.IsNotExist(err) {
+		return quarantined, nil
+	}
+	if err != nil {
+		return nil, errors.Errorf("reading quarantine file error %+v", err)
+	}
+
+	if err := json.Unmarshal(data, &quarantined); err != nil {
+		return nil, errors.Errorf("unable to unmarshal quarantine file %+v", err)
+	}
+	return quarantined, nil
+}
+
+func writeQuarantine(fileMgr utils.FileManager, quarantined []mailbox.QuarantinedMessage) error {
+	encodedQuarantine, err := json.MarshalIndent(quarantined, "", "  ")
+	if err != nil {
+		return errors.Errorf("converting quarantine to JSON error %+v", err)
+	}
+
+	if err := fileMgr.WriteFile(base.QuarantineFile, encodedQuarantine, 0644); err != nil {
+		return errors.Errorf("writing quarantine file error %+v", err)
+	}
+	return nil
+}
+
+// recordQuarantine adds messages which were just moved to quarantine, so sweep can find them
+func recordQuarantine(fileMgr utils.FileManager, moved []mailbox.QuarantinedMessage) error {
+	if len(moved) == 0 {
+		return nil
+	}
+
+	quarantined, err := readQuarantine(fileMgr)
+	if err != nil {
+		return err
+	}
+	return writeQuarantine(fileMgr, append(quarantined, moved...))
+}
+
+func sweepQuarantine(ctx context.Context, logger *slog.Logger) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		_, span := tracer.Start(ctx, "sweepQuarantine")
+		defer span.End()
+
+		folder, _, err := loadQuarantine()
+		if err != nil {
+			return err
+		}
+		if folder == "" {
+			return errors.Errorf("environment variable %s is not set", QUARANTINE_FOLDER)
+		}
+
+		// Storage is keyed by the IMAP username
+		if err := requireEnv(IMAP_USER); err != nil {
+			return err
+		}
+
+		fileMgr, err := newFileManager(os.Getenv(IMAP_USER))
+		if err != nil {
+			return err
+		}
+
+		runCtx, release, err := acquireLease(ctx, c, logger, fileMgr)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		quarantined, err := readQuarantine(fileMgr)
+		if err != nil {
+			return err
+		}
+
+		isi, err := newImapManager(runCtx, logger)
+		if err != nil {
+			return err
+		}
+
+		folder, err = isi.ServerMailboxName(folder)
+		if err != nil {
+			return errors.Errorf("listing mailboxes error %+v", err)
+		}
+
+		mb, err := isi.Mailbox(
+			base.SerializedMailbox{Name: folder, Deletable: true},
+			mailbox.WithDryRun(c.Bool("dry-run")),
+		)
+		if err != nil {
+			return errors.Errorf("unable to create mailbox %+v", err)
+		}
+
+		remaining, deleted, err := mb.SweepQuarantine(quarantined, time.Now())
+		if err != nil {
+			return errors.Errorf("sweeping %s error %+v", folder, err)
+		}
+
+		if c.Bool("dry-run") {
+			fmt.Fprintf(c.App.Writer, "Dry run, would delete %d quarantined messages from %s\n", deleted, folder) //nolint:errcheck
+			return nil
+		}
+
+		if err := writeQuarantine(fileMgr, remaining); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.Writer, "Deleted %d quarantined messages from %s, %d are waiting\n", deleted, folder, len(remaining)) //nolint:errcheck
+
+		return nil
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"aaronromeo.com/postmanpat/pkg/models/mailbox"
+	"aaronromeo.com/postmanpat/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// runRecord tells which run exported what, so files under an export prefix can be traced back
+// to the run and account which wrote them
+type runRecord struct {
+	RunID        string    `json:"runId"`
+	Account      string    `json:"account"`
+	ExportFolder string    `json:"exportFolder"`
+	DryRun       bool      `json:"dryRun"`
+	StartedAt    time.Time `json:"startedAt"`
+	FinishedAt   time.Time `json:"finishedAt"`
+	ExportErrors int       `json:"exportErrors"`
+	Error        string    `json:"error,omitempty"`
+
+	// exportPrefix is the expanded EXPORTS_PREFIX, the run exports to it inside the exports folder
+	exportPrefix string
+}
+
+// newRunID names a run by when it started, with a random suffix for runs starting together
+func newRunID(now time.Time) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", errors.Errorf("generating run ID error %+v", err)
+	}
+	return fmt.Sprintf("%s-%s", now.UTC().Format(backupTimestampFormat), hex.EncodeToString(suffix)), nil
+}
+
+// newRunRecord starts the record of a run for the account, with the export prefix expanded from
+// the configured template
+func newRunRecord(c *cli.Context, account string) (*runRecord, error) {
+	now := time.Now()
+	runID, err := newRunID(now)
+	if err != nil {
+		return nil, err
+	}
+
+	location, err := loadLocation()
+	if err != nil {
+		return nil, err
+	}
+
+	exportPrefix, err := mailbox.ExpandExportPrefix(os.Getenv(EXPORTS_PREFIX), account, runID, now.In(location))
+	if err != nil {
+		return nil, errors.Errorf("invalid value for %s: %+v", EXPORTS_PREFIX, err)
+	}
+
+	return &runRecord{
+		RunID:        runID,
+		Account:      account,
+		ExportFolder: path.Join(base.ExportsFolder, exportPrefix),
+		DryRun:       c.Bool("dry-run"),
+		StartedAt:    now,
+		exportPrefix: exportPrefix,
+	}, nil
+}
+
+// runRecordFile is where the record of a run is kept
+func runRecordFile(runID string) string {
+	return path.Join(base.RunsFolder, runID+".json")
+}
+
+// write stores the record once the run has finished, err is the error the run ended with
+func (record *runRecord) write(fileMgr utils.FileManager, err error) error {
+	record.FinishedAt = time.Now()
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	encodedRecord, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return errors.Errorf("converting run record to JSON error %+v", err)
+	}
+
+	if err := fileMgr.WriteFile(runRecordFile(record.RunID), encodedRecord, 0644); err != nil {
+		return errors.Errorf("writing run record file error %+v", err)
+	}
+	return nil
+}
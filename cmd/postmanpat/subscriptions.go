@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	imap "aaronromeo.com/postmanpat/pkg/models/imapmanager"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+func listSubscriptions(ctx context.Context, logger *slog.Logger) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		_, span := tracer.Start(ctx, "listSubscriptions")
+		defer span.End()
+
+		isi, err := newImapManager(ctx, logger)
+		if err != nil {
+			return err
+		}
+
+		names, err := isi.GetSubscribedMailboxNames()
+		if err != nil {
+			return errors.Errorf("listing subscribed mailboxes error %+v", err)
+		}
+
+		for _, name := range names {
+			fmt.Fprintln(c.App.Writer, name) //nolint:errcheck
+		}
+
+		return nil
+	}
+}
+
+func subscribe(ctx context.Context, logger *slog.Logger) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		_, span := tracer.Start(ctx, "subscribe")
+		defer span.End()
+
+		if c.Args().First() == "" {
+			return errors.New("requires a mailbox name")
+		}
+
+		isi, err := newImapManager(ctx, logger)
+		if err != nil {
+			return err
+		}
+
+		name, err := isi.ServerMailboxName(c.Args().First())
+		if err != nil {
+			return errors.Errorf("listing mailboxes error %+v", err)
+		}
+
+		if err := isi.Subscribe(name); err != nil {
+			return errors.Errorf("subscribing to %s error %+v", name, err)
+		}
+
+		return nil
+	}
+}
+
+func unsubscribe(ctx context.Context, logger *slog.Logger) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		_, span := tracer.Start(ctx, "unsubscribe")
+		defer span.End()
+
+		if c.Args().First() == "" {
+			return errors.New("requires a mailbox name")
+		}
+
+		isi, err := newImapManager(ctx, logger)
+		if err != nil {
+			return err
+		}
+
+		name, err := isi.ServerMailboxName(c.Args().First())
+		if err != nil {
+			return errors.Errorf("listing mailboxes error %+v", err)
+		}
+
+		if err := isi.Unsubscribe(name); err != nil {
+			return errors.Errorf("unsubscribing from %s error %+v", name, err)
+		}
+
+		return nil
+	}
+}
+
+// subscribedMailboxes is the set of mailboxes the user is subscribed to
+func subscribedMailboxes(isi *imap.ImapManagerImpl) (map[string]bool, error) {
+	subscribedNames, err := isi.GetSubscribedMailboxNames()
+	if err != nil {
+		return nil, errors.Errorf("getting subscribed mailboxes error %+v", err)
+	}
+
+	subscribed := make(map[string]bool, len(subscribedNames))
+	for _, name := range subscribedNames {
+		subscribed[name] = true
+	}
+	return subscribed, nil
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+)
+
+// AssetsPath is the URL path assets are served under
+const AssetsPath = "/assets"
+
+// immutableCacheControl lets browsers keep an asset for good, a changed asset gets a new URL
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// AssetManifest gives each file in the assets folder a URL holding a hash of its contents, so
+// browsers can cache assets forever and still pick up a change straight away. Assets are small,
+// so they are kept in memory along with a gzipped copy.
+type AssetManifest struct {
+	root string
+
+	mu sync.RWMutex
+	// urls maps a path relative to the assets folder, such as "css/app.css", to the URL it is
+	// served at. Files with the same name in different folders each keep their own URL.
+	urls map[string]string
+	// assets maps a hashed path below AssetsPath to the asset
+	assets map[string]asset
+}
+
+type asset struct {
+	ext     string
+	body    []byte
+	gzipped []byte
+}
+
+// NewAssetManifest loads the files in root
+func NewAssetManifest(root string) (*AssetManifest, error) {
+	am := &AssetManifest{root: root}
+	if err := am.Load(); err != nil {
+		return nil, err
+	}
+	return am, nil
+}
+
+// Load reads the files in the assets folder again, picking up any which changed
+func (am *AssetManifest) Load() error {
+	urls := map[string]string{}
+	assets := map[string]asset{}
+	err := filepath.WalkDir(am.root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		body, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		gzipped, err := gzipBytes(body)
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(am.root, filePath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		ext := path.Ext(relPath)
+		hash := sha256.Sum256(body)
+		hashedPath := strings.TrimSuffix(relPath, ext) + "." + hex.EncodeToString(hash[:8]) + ext
+
+		urls[relPath] = path.Join(AssetsPath, hashedPath)
+		assets[hashedPath] = asset{ext: ext, body: body, gzipped: gzipped}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "building the asset manifest for %s", am.root)
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	am.urls = urls
+	am.assets = assets
+	return nil
+}
+
+func gzipBytes(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// URL is where the asset at relPath, relative to the assets folder and separated by slashes, is
+// served
+func (am *AssetManifest) URL(relPath string) (string, bool) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	url, ok := am.urls[relPath]
+	return url, ok
+}
+
+// Serve sends the asset at a hashed path, gzipped when the browser accepts it. Mount it at
+// AssetsPath + "/*".
+func (am *AssetManifest) Serve(c *fiber.Ctx) error {
+	am.mu.RLock()
+	a, ok := am.assets[c.Params("*")]
+	am.mu.RUnlock()
+	if !ok {
+		return c.Next()
+	}
+
+	c.Type(a.ext)
+	c.Set(fiber.HeaderCacheControl, immutableCacheControl)
+	c.Vary(fiber.HeaderAcceptEncoding)
+	// Only send gzip when asked for, a missing header doesn't mean the client can read it
+	if strings.Contains(c.Get(fiber.HeaderAcceptEncoding), "gzip") {
+		c.Set(fiber.HeaderContentEncoding, "gzip")
+		return c.Send(a.gzipped)
+	}
+	return c.Send(a.body)
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeAsset(t *testing.T, root, relPath, body string) {
+	t.Helper()
+	filePath := filepath.Join(root, filepath.FromSlash(relPath))
+	assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0o755))
+	assert.NoError(t, os.WriteFile(filePath, []byte(body), 0o644))
+}
+
+func TestAssetManifest(t *testing.T) {
+	root := t.TempDir()
+	writeAsset(t, root, "app.css", "body { color: black; }")
+	writeAsset(t, root, "print/app.css", "body { color: gray; }")
+
+	am, err := NewAssetManifest(root)
+	assert.NoError(t, err)
+
+	rootURL, ok := am.URL("app.css")
+	assert.True(t, ok)
+	assert.Regexp(t, regexp.MustCompile(`^/assets/app\.[0-9a-f]{16}\.css$`), rootURL)
+
+	// A file with the same name in a subfolder keeps its own URL
+	printURL, ok := am.URL("print/app.css")
+	assert.True(t, ok)
+	assert.Regexp(t, regexp.MustCompile(`^/assets/print/app\.[0-9a-f]{16}\.css$`), printURL)
+
+	_, ok = am.URL("missing.css")
+	assert.False(t, ok)
+
+	// A changed file gets a new URL once loaded again
+	writeAsset(t, root, "app.css", "body { color: white; }")
+	assert.NoError(t, am.Load())
+	changedURL, ok := am.URL("app.css")
+	assert.True(t, ok)
+	assert.NotEqual(t, rootURL, changedURL)
+	unchangedURL, _ := am.URL("print/app.css")
+	assert.Equal(t, printURL, unchangedURL)
+}
+
+func TestAssetManifestServe(t *testing.T) {
+	body := "body { color: black; }"
+	root := t.TempDir()
+	writeAsset(t, root, "app.css", body)
+
+	am, err := NewAssetManifest(root)
+	assert.NoError(t, err)
+	url, _ := am.URL("app.css")
+
+	app := fiber.New()
+	app.Get(AssetsPath+"/*", am.Serve)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		gzipped        bool
+	}{
+		{name: "gzip accepted", acceptEncoding: "gzip, deflate, br", gzipped: true},
+		{name: "gzip not accepted", acceptEncoding: "br", gzipped: false},
+		{name: "no accept encoding", acceptEncoding: "", gzipped: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(fiber.MethodGet, url, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set(fiber.HeaderAcceptEncoding, tt.acceptEncoding)
+			}
+			resp, err := app.Test(req)
+			assert.NoError(t, err)
+			defer resp.Body.Close() //nolint:errcheck
+
+			assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+			assert.Contains(t, resp.Header.Get(fiber.HeaderContentType), "text/css")
+			assert.Equal(t, immutableCacheControl, resp.Header.Get(fiber.HeaderCacheControl))
+			// Caches must keep the gzipped and the plain responses apart
+			assert.Equal(t, fiber.HeaderAcceptEncoding, resp.Header.Get(fiber.HeaderVary))
+
+			sent, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			if tt.gzipped {
+				assert.Equal(t, "gzip", resp.Header.Get(fiber.HeaderContentEncoding))
+				zr, err := gzip.NewReader(bytes.NewReader(sent))
+				assert.NoError(t, err)
+				sent, err = io.ReadAll(zr)
+				assert.NoError(t, err)
+			} else {
+				assert.Empty(t, resp.Header.Get(fiber.HeaderContentEncoding))
+			}
+			assert.Equal(t, body, string(sent))
+		})
+	}
+}
+
+func TestAssetManifestServeUnknownPath(t *testing.T) {
+	root := t.TempDir()
+	writeAsset(t, root, "app.css", "body { color: black; }")
+
+	am, err := NewAssetManifest(root)
+	assert.NoError(t, err)
+
+	app := fiber.New()
+	app.Get(AssetsPath+"/*", am.Serve)
+
+	// The unhashed path isn't served, so a stale URL can't be cached forever
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, AssetsPath+"/app.css", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+}
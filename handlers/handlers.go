@@ -1,14 +1,9 @@
 package handlers
 
 import (
-	"encoding/json"
 	"fmt"
 
-	"aaronromeo.com/postmanpat/pkg/base"
-	"aaronromeo.com/postmanpat/pkg/models/mailbox"
-	"aaronromeo.com/postmanpat/pkg/utils"
 	"github.com/gofiber/fiber/v2"
-	"github.com/pkg/errors"
 )
 
 // Home renders the home view
@@ -28,30 +23,36 @@ func NotFound(c *fiber.Ctx) error {
 	return c.Status(404).Render("404", nil)
 }
 
-// Home renders the home view
+// Mailboxes renders a page of the mailbox list, searched with q and sorted with sort and order
 func Mailboxes(c *fiber.Ctx) error {
-	fileMgr, ok := c.Locals("fileMgr").(utils.FileManager)
+	mailboxList, ok := c.Locals("mailboxList").(*MailboxListCache)
 	if !ok {
-		return c.Status(fiber.StatusInternalServerError).SendString("Could not retrieve file manager")
+		return c.Status(fiber.StatusInternalServerError).SendString("Could not retrieve mailbox list")
 	}
 
-	data, err := fileMgr.ReadFile(base.MailboxListFile)
+	mailboxes, err := mailboxList.Mailboxes()
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).SendString(
 			fmt.Sprintf("Reading mailbox error %+v", err),
 		)
 	}
-	defer fileMgr.Close() //nolint:errcheck
-
-	mailboxes := make(map[string]mailbox.MailboxImpl)
 
-	err = json.Unmarshal(data, &mailboxes)
-	if err != nil {
-		return errors.Errorf("unable to marshal mailboxes %+v", err)
-	}
+	query := mailboxesQuery{
+		Search: c.Query("q"),
+		Sort:   c.Query("sort"),
+		Order:  c.Query("order"),
+		Page:   c.QueryInt("page", 1),
+	}.normalize()
+	page := pageMailboxes(mailboxes, query)
 
 	return c.Render("mailboxes/index", fiber.Map{
-		"Title":     "Hello, World!",
-		"Mailboxes": mailboxes,
+		"Title":     "Mailboxes",
+		"Mailboxes": page.Mailboxes,
+		"Total":     page.Total,
+		"Page":      page.Page,
+		"Pages":     page.Pages,
+		"PrevPage":  page.PrevPage,
+		"NextPage":  page.NextPage,
+		"Query":     query,
 	})
 }
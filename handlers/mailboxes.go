@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"aaronromeo.com/postmanpat/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// MailboxesPageSize is the number of mailboxes listed on a page
+const MailboxesPageSize = 50
+
+// MailboxListCache keeps the decoded mailbox list for a while, so paging through it doesn't read
+// storage on every request. Changes made by mailboxnames show up once the cache expires.
+type MailboxListCache struct {
+	fileMgr utils.FileManager
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu        sync.Mutex
+	mailboxes []base.SerializedMailbox
+	loadedAt  time.Time
+}
+
+// NewMailboxListCache reads the mailbox list from fileMgr at most once every ttl
+func NewMailboxListCache(fileMgr utils.FileManager, ttl time.Duration) *MailboxListCache {
+	return &MailboxListCache{fileMgr: fileMgr, ttl: ttl, now: time.Now}
+}
+
+// Mailboxes is the mailbox list sorted by name. The slice is shared, copy it before changing it.
+func (mc *MailboxListCache) Mailboxes() ([]base.SerializedMailbox, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.mailboxes != nil && mc.now().Sub(mc.loadedAt) < mc.ttl {
+		return mc.mailboxes, nil
+	}
+
+	reader, err := mc.fileMgr.Open(base.MailboxListFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading mailbox list")
+	}
+	defer reader.Close() //nolint:errcheck
+
+	storedMailboxes := make(map[string]base.SerializedMailbox)
+	if err := json.NewDecoder(reader).Decode(&storedMailboxes); err != nil {
+		return nil, errors.Wrap(err, "unable to unmarshal mailboxes")
+	}
+
+	mailboxes := make([]base.SerializedMailbox, 0, len(storedMailboxes))
+	for name, serializedMailbox := range storedMailboxes {
+		serializedMailbox.Name = name
+		mailboxes = append(mailboxes, serializedMailbox)
+	}
+	sort.Slice(mailboxes, func(i, j int) bool { return mailboxes[i].Name < mailboxes[j].Name })
+
+	mc.mailboxes = mailboxes
+	mc.loadedAt = mc.now()
+	return mailboxes, nil
+}
+
+// mailboxesQuery is the search, sort and page asked for on the mailboxes page
+type mailboxesQuery struct {
+	Search string
+	// Sort is "name" or "lifespan"
+	Sort string
+	// Order is "asc" or "desc"
+	Order string
+	// Page counts from 1
+	Page int
+}
+
+// normalize falls back to the first page sorted by name for anything unknown
+func (q mailboxesQuery) normalize() mailboxesQuery {
+	q.Search = strings.TrimSpace(q.Search)
+	if q.Sort != "lifespan" {
+		q.Sort = "name"
+	}
+	if q.Order != "desc" {
+		q.Order = "asc"
+	}
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	return q
+}
+
+// mailboxesPage is one page of the mailboxes matching a query
+type mailboxesPage struct {
+	Mailboxes []base.SerializedMailbox
+	Total     int
+	Page      int
+	Pages     int
+	// PrevPage and NextPage are 0 when there is no such page
+	PrevPage int
+	NextPage int
+}
+
+// pageMailboxes filters, sorts and pages the mailboxes
+func pageMailboxes(mailboxes []base.SerializedMailbox, query mailboxesQuery) mailboxesPage {
+	matched := make([]base.SerializedMailbox, 0, len(mailboxes))
+	search := strings.ToLower(query.Search)
+	for _, serializedMailbox := range mailboxes {
+		if strings.Contains(strings.ToLower(serializedMailbox.Name), search) {
+			matched = append(matched, serializedMailbox)
+		}
+	}
+
+	desc := query.Order == "desc"
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if query.Sort == "lifespan" && a.Lifespan != b.Lifespan {
+			return (a.Lifespan < b.Lifespan) != desc
+		}
+		// Mailboxes with the same lifespan are listed by name, in name order either way
+		if query.Sort == "name" && desc {
+			return a.Name > b.Name
+		}
+		return a.Name < b.Name
+	})
+
+	pages := max((len(matched)+MailboxesPageSize-1)/MailboxesPageSize, 1)
+	page := min(query.Page, pages)
+	start := (page - 1) * MailboxesPageSize
+	end := min(start+MailboxesPageSize, len(matched))
+
+	result := mailboxesPage{
+		Mailboxes: matched[start:end],
+		Total:     len(matched),
+		Page:      page,
+		Pages:     pages,
+	}
+	if page > 1 {
+		result.PrevPage = page - 1
+	}
+	if page < pages {
+		result.NextPage = page + 1
+	}
+	return result
+}
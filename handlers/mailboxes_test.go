@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"aaronromeo.com/postmanpat/pkg/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func mailboxNames(mailboxes []base.SerializedMailbox) []string {
+	names := make([]string, 0, len(mailboxes))
+	for _, serializedMailbox := range mailboxes {
+		names = append(names, serializedMailbox.Name)
+	}
+	return names
+}
+
+func TestMailboxesQueryNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    mailboxesQuery
+		expected mailboxesQuery
+	}{
+		{
+			name:     "defaults",
+			query:    mailboxesQuery{},
+			expected: mailboxesQuery{Sort: "name", Order: "asc", Page: 1},
+		},
+		{
+			name:     "keeps a valid query",
+			query:    mailboxesQuery{Search: "work", Sort: "lifespan", Order: "desc", Page: 3},
+			expected: mailboxesQuery{Search: "work", Sort: "lifespan", Order: "desc", Page: 3},
+		},
+		{
+			name:     "falls back for unknown values",
+			query:    mailboxesQuery{Search: "  work ", Sort: "size", Order: "up", Page: -2},
+			expected: mailboxesQuery{Search: "work", Sort: "name", Order: "asc", Page: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.query.normalize())
+		})
+	}
+}
+
+func TestPageMailboxes(t *testing.T) {
+	mailboxes := []base.SerializedMailbox{
+		{Name: "Archive", Lifespan: 365},
+		{Name: "INBOX", Lifespan: 30},
+		{Name: "Newsletters", Lifespan: 7},
+		{Name: "Receipts", Lifespan: 30},
+		{Name: "Work/Projects", Lifespan: 30},
+	}
+
+	tests := []struct {
+		name      string
+		query     mailboxesQuery
+		wantNames []string
+		wantTotal int
+		wantPage  int
+		wantPrev  int
+		wantNext  int
+	}{
+		{
+			name:      "name ascending",
+			query:     mailboxesQuery{Sort: "name", Order: "asc", Page: 1},
+			wantNames: []string{"Archive", "INBOX", "Newsletters", "Receipts", "Work/Projects"},
+			wantTotal: 5,
+			wantPage:  1,
+		},
+		{
+			name:      "name descending",
+			query:     mailboxesQuery{Sort: "name", Order: "desc", Page: 1},
+			wantNames: []string{"Work/Projects", "Receipts", "Newsletters", "INBOX", "Archive"},
+			wantTotal: 5,
+			wantPage:  1,
+		},
+		{
+			name:      "lifespan ascending breaks ties by name",
+			query:     mailboxesQuery{Sort: "lifespan", Order: "asc", Page: 1},
+			wantNames: []string{"Newsletters", "INBOX", "Receipts", "Work/Projects", "Archive"},
+			wantTotal: 5,
+			wantPage:  1,
+		},
+		{
+			name:      "lifespan descending still breaks ties by name",
+			query:     mailboxesQuery{Sort: "lifespan", Order: "desc", Page: 1},
+			wantNames: []string{"Archive", "INBOX", "Receipts", "Work/Projects", "Newsletters"},
+			wantTotal: 5,
+			wantPage:  1,
+		},
+		{
+			name:      "search ignores case",
+			query:     mailboxesQuery{Search: "O", Sort: "name", Order: "asc", Page: 1},
+			wantNames: []string{"INBOX", "Work/Projects"},
+			wantTotal: 2,
+			wantPage:  1,
+		},
+		{
+			name:      "no matches is an empty first page",
+			query:     mailboxesQuery{Search: "missing", Sort: "name", Order: "asc", Page: 1},
+			wantNames: []string{},
+			wantTotal: 0,
+			wantPage:  1,
+		},
+		{
+			name:      "a page past the end is the last page",
+			query:     mailboxesQuery{Sort: "name", Order: "asc", Page: 9},
+			wantNames: []string{"Archive", "INBOX", "Newsletters", "Receipts", "Work/Projects"},
+			wantTotal: 5,
+			wantPage:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := pageMailboxes(mailboxes, tt.query)
+			assert.Equal(t, tt.wantNames, mailboxNames(page.Mailboxes))
+			assert.Equal(t, tt.wantTotal, page.Total)
+			assert.Equal(t, tt.wantPage, page.Page)
+			assert.Equal(t, 1, page.Pages)
+			assert.Equal(t, tt.wantPrev, page.PrevPage)
+			assert.Equal(t, tt.wantNext, page.NextPage)
+		})
+	}
+
+	// Sorting works on a copy, the cached list stays in name order
+	assert.Equal(t, []string{"Archive", "INBOX", "Newsletters", "Receipts", "Work/Projects"}, mailboxNames(mailboxes))
+}
+
+func TestPageMailboxesPages(t *testing.T) {
+	mailboxes := make([]base.SerializedMailbox, 0, 2*MailboxesPageSize+1)
+	for i := 0; i < 2*MailboxesPageSize+1; i++ {
+		mailboxes = append(mailboxes, base.SerializedMailbox{Name: fmt.Sprintf("Folder%03d", i)})
+	}
+
+	tests := []struct {
+		name      string
+		page      int
+		wantPage  int
+		wantFirst string
+		wantLen   int
+		wantPrev  int
+		wantNext  int
+	}{
+		{name: "first", page: 1, wantPage: 1, wantFirst: "Folder000", wantLen: MailboxesPageSize, wantNext: 2},
+		{name: "middle", page: 2, wantPage: 2, wantFirst: "Folder050", wantLen: MailboxesPageSize, wantPrev: 1, wantNext: 3},
+		{name: "last", page: 3, wantPage: 3, wantFirst: "Folder100", wantLen: 1, wantPrev: 2},
+		{name: "past the end", page: 4, wantPage: 3, wantFirst: "Folder100", wantLen: 1, wantPrev: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := pageMailboxes(mailboxes, mailboxesQuery{Sort: "name", Order: "asc", Page: tt.page})
+			assert.Equal(t, 3, page.Pages)
+			assert.Equal(t, tt.wantPage, page.Page)
+			assert.Len(t, page.Mailboxes, tt.wantLen)
+			assert.Equal(t, tt.wantFirst, page.Mailboxes[0].Name)
+			assert.Equal(t, tt.wantPrev, page.PrevPage)
+			assert.Equal(t, tt.wantNext, page.NextPage)
+		})
+	}
+}
+
+func TestMailboxListCache(t *testing.T) {
+	fileMgr := mock.MockFileWriter{Writers: map[string]mock.MockWriter{}}
+	writeList := func(list string) {
+		fileMgr.Writers[base.MailboxListFile] = mock.MockWriter{Buffer: bytes.NewBufferString(list)}
+	}
+	writeList(`{"Work": {"lifespan": 30}, "INBOX": {"lifespan": 7}}`)
+
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	cache := NewMailboxListCache(fileMgr, 30*time.Second)
+	cache.now = func() time.Time { return now }
+
+	mailboxes, err := cache.Mailboxes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"INBOX", "Work"}, mailboxNames(mailboxes))
+
+	// Changes aren't read until the cache expires
+	writeList(`{"Archive": {"lifespan": 365}}`)
+	now = now.Add(29 * time.Second)
+	mailboxes, err = cache.Mailboxes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"INBOX", "Work"}, mailboxNames(mailboxes))
+
+	now = now.Add(time.Second)
+	mailboxes, err = cache.Mailboxes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Archive"}, mailboxNames(mailboxes))
+
+	// A list which can't be read isn't cached
+	delete(fileMgr.Writers, base.MailboxListFile)
+	now = now.Add(time.Minute)
+	_, err = cache.Mailboxes()
+	assert.Error(t, err)
+}
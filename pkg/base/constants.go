@@ -2,7 +2,15 @@ package base
 
 const (
 	MailboxListFile     = "workingfiles/mailboxlist.json"
+	ExportErrorsFile    = "workingfiles/exporterrors.json"
+	ReapPlanFile        = "workingfiles/reapplan.json"
+	LeaseFile           = "workingfiles/lease.json"
+	BackupsFolder       = "workingfiles/backups"
+	ExportsFolder       = "exportedemails"
+	RunsFolder          = "workingfiles/runs"
+	QuarantineFile      = "workingfiles/quarantine.json"
 	OTEL_NAME           = "postmanpat"
+	OTEL_EXPORTER_ENV   = "OTEL_EXPORTER"
 	UPTRACE_DSN_ENV_VAR = "UPTRACE_DSN"
 	UPTRACE_SERVICE     = "postmanpat"
 )
@@ -0,0 +1,48 @@
+package base
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap/utf7"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeMailboxName returns the UTF-8 form of a mailbox name so names from the server, the
+// mailbox list and the command line compare equal. It is only a key for comparing names, commands
+// must be sent the name as the server lists it, see FindMailboxName.
+//
+// go-imap already decodes modified UTF-7 on the wire, but a mailbox list written by hand or by
+// another tool may hold the encoded form ("Entw&APw-rfe"). Those names are decoded, and anything
+// which isn't valid modified UTF-7 is kept as is. The result is NFC so a decomposed "ü" matches
+// the precomposed one.
+func NormalizeMailboxName(name string) string {
+	if strings.Contains(name, "&") {
+		if decoded, err := utf7.Encoding.NewDecoder().String(name); err == nil {
+			name = decoded
+		}
+	}
+	return norm.NFC.String(name)
+}
+
+// FindMailboxName looks up the key in mailboxes naming the same mailbox as name. The exact name is
+// preferred, otherwise a key which normalizes to the same name is returned, the first in sort
+// order when there are several.
+func FindMailboxName[T any](mailboxes map[string]T, name string) (string, bool) {
+	if _, ok := mailboxes[name]; ok {
+		return name, true
+	}
+
+	normalized := NormalizeMailboxName(name)
+	matches := []string{}
+	for key := range mailboxes {
+		if NormalizeMailboxName(key) == normalized {
+			matches = append(matches, key)
+		}
+	}
+	if len(matches) == 0 {
+		return "", false
+	}
+	sort.Strings(matches)
+	return matches[0], true
+}
@@ -0,0 +1,59 @@
+package base
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeMailboxName(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{name: "ascii", input: "INBOX", expected: "INBOX"},
+		{name: "hierarchy", input: "[Gmail]/Sent Mail", expected: "[Gmail]/Sent Mail"},
+		{name: "utf7 latin", input: "Entw&APw-rfe", expected: "Entwürfe"},
+		{name: "utf7 cyrillic", input: "&BBoEPgRABDcEOAQ9BDA-", expected: "Корзина"},
+		{name: "utf7 ampersand", input: "R&-D", expected: "R&D"},
+		{name: "already decoded", input: "Корзина", expected: "Корзина"},
+		{name: "invalid utf7 is kept", input: "Tom & Jerry", expected: "Tom & Jerry"},
+		{name: "decomposed is composed", input: "Entwu\u0308rfe", expected: "Entwürfe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, NormalizeMailboxName(tt.input))
+		})
+	}
+}
+
+func TestFindMailboxName(t *testing.T) {
+	mailboxes := map[string]bool{
+		"INBOX":          true,
+		"Entwu\u0308rfe": true,
+		"Entw&APw-rfe":   true,
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		found    bool
+	}{
+		{name: "exact", input: "INBOX", expected: "INBOX", found: true},
+		{name: "exact decomposed", input: "Entwu\u0308rfe", expected: "Entwu\u0308rfe", found: true},
+		{name: "exact ampersand", input: "Entw&APw-rfe", expected: "Entw&APw-rfe", found: true},
+		{name: "normalized", input: "Entwürfe", expected: "Entw&APw-rfe", found: true},
+		{name: "missing", input: "Archive", expected: "", found: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, found := FindMailboxName(mailboxes, tt.input)
+			assert.Equal(t, tt.expected, name)
+			assert.Equal(t, tt.found, found)
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package base
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/pkg/errors"
+)
+
+// ErrReadOnly is returned for any command that would modify a mailbox on a read-only client
+var ErrReadOnly = errors.New("client is read-only")
+
+// ReadOnlyClient wraps a Client so mailboxes are always opened with EXAMINE and
+// mutating commands are refused before they reach the server
+type ReadOnlyClient struct {
+	Client
+}
+
+func NewReadOnlyClient(c Client) *ReadOnlyClient {
+	return &ReadOnlyClient{Client: c}
+}
+
+// Select always opens the mailbox read-only, regardless of what the caller asked for
+func (c *ReadOnlyClient) Select(name string, _ bool) (*imap.MailboxStatus, error) {
+	return c.Client.Select(name, true)
+}
+
+// Store is refused on a read-only client
+func (c *ReadOnlyClient) Store(_ *imap.SeqSet, _ imap.StoreItem, _ interface{}, ch chan *imap.Message) error {
+	if ch != nil {
+		close(ch)
+	}
+	return ErrReadOnly
+}
+
+// Expunge is refused on a read-only client
+func (c *ReadOnlyClient) Expunge(ch chan uint32) error {
+	if ch != nil {
+		close(ch)
+	}
+	return ErrReadOnly
+}
+
+// UidStore is refused on a read-only client
+func (c *ReadOnlyClient) UidStore(_ *imap.SeqSet, _ imap.StoreItem, _ interface{}, ch chan *imap.Message) error {
+	if ch != nil {
+		close(ch)
+	}
+	return ErrReadOnly
+}
+
+// UidExpunge is refused on a read-only client
+func (c *ReadOnlyClient) UidExpunge(_ *imap.SeqSet, ch chan uint32) error {
+	if ch != nil {
+		close(ch)
+	}
+	return ErrReadOnly
+}
+
+// Move is refused on a read-only client
+func (c *ReadOnlyClient) Move(_ *imap.SeqSet, _ string) error {
+	return ErrReadOnly
+}
+
+// Rename is refused on a read-only client
+func (c *ReadOnlyClient) Rename(_, _ string) error {
+	return ErrReadOnly
+}
+
+// Create is refused on a read-only client
+func (c *ReadOnlyClient) Create(_ string) error {
+	return ErrReadOnly
+}
+
+// Subscribe is refused on a read-only client
+func (c *ReadOnlyClient) Subscribe(_ string) error {
+	return ErrReadOnly
+}
+
+// Unsubscribe is refused on a read-only client
+func (c *ReadOnlyClient) Unsubscribe(_ string) error {
+	return ErrReadOnly
+}
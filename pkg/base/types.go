@@ -2,6 +2,18 @@ package base
 
 import (
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-sasl"
+	"github.com/pkg/errors"
+)
+
+// AgeBasis picks which date a mailbox's lifespan is measured from
+type AgeBasis string
+
+const (
+	// AgeBasisInternal measures age from the IMAP internal date, when the server received the message
+	AgeBasisInternal AgeBasis = "internal"
+	// AgeBasisHeader measures age from the Date header, when the sender says the message was written
+	AgeBasisHeader AgeBasis = "header"
 )
 
 type SerializedMailbox struct {
@@ -9,19 +21,47 @@ type SerializedMailbox struct {
 	Deletable  bool   `json:"delete"`
 	Exportable bool   `json:"export"`
 	Lifespan   int    `json:"lifespan"`
+	// AgeBasis defaults to AgeBasisInternal when empty
+	AgeBasis AgeBasis `json:"ageBasis,omitempty"`
+}
+
+// Validate checks the settings can be applied to the mailbox
+func (s SerializedMailbox) Validate() error {
+	switch s.AgeBasis {
+	case "", AgeBasisInternal, AgeBasisHeader:
+		return nil
+	default:
+		return errors.Errorf(
+			"mailbox %s has an invalid ageBasis %q: use %q to measure the lifespan from when the server received a message (imported or moved mail counts as new), or %q to measure it from the Date header set by the sender (which can be missing or wrong)",
+			s.Name, s.AgeBasis, AgeBasisInternal, AgeBasisHeader,
+		)
+	}
 }
 
 // Client is an interface to abstract the client.Client methods used
 type Client interface {
+	Authenticate(auth sasl.Client) error
+	Capability() (map[string]bool, error)
+	Create(name string) error
 	Expunge(ch chan uint32) error
 	Fetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error
 	List(ref, name string, ch chan *imap.MailboxInfo) error
 	Login(username string, password string) error
 	Logout() error
+	Lsub(ref, name string, ch chan *imap.MailboxInfo) error
+	Move(seqset *imap.SeqSet, dest string) error
+	Rename(existingName, newName string) error
 	Search(criteria *imap.SearchCriteria) (seqNums []uint32, err error)
 	Select(name string, readOnly bool) (*imap.MailboxStatus, error)
 	State() imap.ConnState
 	Store(seqset *imap.SeqSet, item imap.StoreItem, value interface{}, ch chan *imap.Message) error
+	Subscribe(name string) error
+	Support(cap string) (bool, error)
+	SupportAuth(mech string) (bool, error)
+	UidExpunge(seqset *imap.SeqSet, ch chan uint32) error
+	UidSearch(criteria *imap.SearchCriteria) (uids []uint32, err error)
+	UidStore(seqset *imap.SeqSet, item imap.StoreItem, value interface{}, ch chan *imap.Message) error
+	Unsubscribe(name string) error
 }
 
 type Service interface {
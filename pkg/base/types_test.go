@@ -0,0 +1,17 @@
+package base
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSerializedMailboxValidate(t *testing.T) {
+	for _, ageBasis := range []AgeBasis{"", AgeBasisInternal, AgeBasisHeader} {
+		assert.NoError(t, SerializedMailbox{Name: "INBOX", AgeBasis: ageBasis}.Validate(), "ageBasis %q", ageBasis)
+	}
+
+	err := SerializedMailbox{Name: "INBOX", AgeBasis: "received"}.Validate()
+	assert.ErrorContains(t, err, `mailbox INBOX has an invalid ageBasis "received"`)
+	assert.ErrorContains(t, err, "Date header")
+}
@@ -3,6 +3,8 @@ package mock
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 
 	"aaronromeo.com/postmanpat/pkg/utils"
@@ -25,6 +27,10 @@ func (m MockWriter) Flush() error {
 	return m.Err
 }
 
+func (m MockWriter) Close() error {
+	return m.Err
+}
+
 type MockFileWriter struct {
 	Err     error
 	Writers map[string]MockWriter
@@ -56,19 +62,24 @@ func (m MockFileWriter) MkdirAll(path string, perm os.FileMode) error {
 	return m.Err
 }
 
+// WriteFile replaces any file already at name, like the real file managers
 func (m MockFileWriter) WriteFile(name string, data []byte, perm os.FileMode) error {
 	if m.Writers == nil {
 		m.Writers = make(map[string]MockWriter)
 	}
 
-	_, ok := m.Writers[name]
-	if ok {
-		return fmt.Errorf("file %s already exists", name)
-	}
 	m.Writers[name] = MockWriter{Buffer: bytes.NewBuffer(data)}
 	return m.Err
 }
 
+func (m MockFileWriter) Open(name string) (io.ReadCloser, error) {
+	data, err := m.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
 func (m MockFileWriter) ReadFile(filename string) ([]byte, error) {
 	if m.Writers == nil {
 		m.Writers = make(map[string]MockWriter)
@@ -76,7 +87,8 @@ func (m MockFileWriter) ReadFile(filename string) ([]byte, error) {
 
 	writer, ok := m.Writers[filename]
 	if !ok {
-		return nil, fmt.Errorf("file %s does not exist", filename)
+		// utils.IsNotExist recognises a missing file the same way as with the OS file manager
+		return nil, &fs.PathError{Op: "open", Path: filename, Err: fs.ErrNotExist}
 	}
 	return writer.Buffer.Bytes(), m.Err
 }
@@ -13,6 +13,7 @@ import (
 	reflect "reflect"
 
 	imap "github.com/emersion/go-imap"
+	sasl "github.com/emersion/go-sasl"
 	gomock "go.uber.org/mock/gomock"
 )
 
@@ -39,6 +40,49 @@ func (m *MockClient) EXPECT() *MockClientMockRecorder {
 	return m.recorder
 }
 
+// Authenticate mocks base method.
+func (m *MockClient) Authenticate(auth sasl.Client) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Authenticate", auth)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Authenticate indicates an expected call of Authenticate.
+func (mr *MockClientMockRecorder) Authenticate(auth any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Authenticate", reflect.TypeOf((*MockClient)(nil).Authenticate), auth)
+}
+
+// Capability mocks base method.
+func (m *MockClient) Capability() (map[string]bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Capability")
+	ret0, _ := ret[0].(map[string]bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Capability indicates an expected call of Capability.
+func (mr *MockClientMockRecorder) Capability() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Capability", reflect.TypeOf((*MockClient)(nil).Capability))
+}
+
+// Create mocks base method.
+func (m *MockClient) Create(name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Create", name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Create indicates an expected call of Create.
+func (mr *MockClientMockRecorder) Create(name any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockClient)(nil).Create), name)
+}
+
 // Expunge mocks base method.
 func (m *MockClient) Expunge(ch chan uint32) error {
 	m.ctrl.T.Helper()
@@ -109,6 +153,48 @@ func (mr *MockClientMockRecorder) Logout() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Logout", reflect.TypeOf((*MockClient)(nil).Logout))
 }
 
+// Lsub mocks base method.
+func (m *MockClient) Lsub(ref, name string, ch chan *imap.MailboxInfo) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Lsub", ref, name, ch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Lsub indicates an expected call of Lsub.
+func (mr *MockClientMockRecorder) Lsub(ref, name, ch any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Lsub", reflect.TypeOf((*MockClient)(nil).Lsub), ref, name, ch)
+}
+
+// Move mocks base method.
+func (m *MockClient) Move(seqset *imap.SeqSet, dest string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Move", seqset, dest)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Move indicates an expected call of Move.
+func (mr *MockClientMockRecorder) Move(seqset, dest any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Move", reflect.TypeOf((*MockClient)(nil).Move), seqset, dest)
+}
+
+// Rename mocks base method.
+func (m *MockClient) Rename(existingName, newName string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Rename", existingName, newName)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Rename indicates an expected call of Rename.
+func (mr *MockClientMockRecorder) Rename(existingName, newName any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rename", reflect.TypeOf((*MockClient)(nil).Rename), existingName, newName)
+}
+
 // Search mocks base method.
 func (m *MockClient) Search(criteria *imap.SearchCriteria) ([]uint32, error) {
 	m.ctrl.T.Helper()
@@ -167,6 +253,107 @@ func (mr *MockClientMockRecorder) Store(seqset, item, value, ch any) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Store", reflect.TypeOf((*MockClient)(nil).Store), seqset, item, value, ch)
 }
 
+// Subscribe mocks base method.
+func (m *MockClient) Subscribe(name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Subscribe", name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Subscribe indicates an expected call of Subscribe.
+func (mr *MockClientMockRecorder) Subscribe(name any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Subscribe", reflect.TypeOf((*MockClient)(nil).Subscribe), name)
+}
+
+// Support mocks base method.
+func (m *MockClient) Support(cap string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Support", cap)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Support indicates an expected call of Support.
+func (mr *MockClientMockRecorder) Support(cap any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Support", reflect.TypeOf((*MockClient)(nil).Support), cap)
+}
+
+// SupportAuth mocks base method.
+func (m *MockClient) SupportAuth(mech string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SupportAuth", mech)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SupportAuth indicates an expected call of SupportAuth.
+func (mr *MockClientMockRecorder) SupportAuth(mech any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SupportAuth", reflect.TypeOf((*MockClient)(nil).SupportAuth), mech)
+}
+
+// UidExpunge mocks base method.
+func (m *MockClient) UidExpunge(seqset *imap.SeqSet, ch chan uint32) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UidExpunge", seqset, ch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UidExpunge indicates an expected call of UidExpunge.
+func (mr *MockClientMockRecorder) UidExpunge(seqset, ch any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UidExpunge", reflect.TypeOf((*MockClient)(nil).UidExpunge), seqset, ch)
+}
+
+// UidSearch mocks base method.
+func (m *MockClient) UidSearch(criteria *imap.SearchCriteria) ([]uint32, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UidSearch", criteria)
+	ret0, _ := ret[0].([]uint32)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UidSearch indicates an expected call of UidSearch.
+func (mr *MockClientMockRecorder) UidSearch(criteria any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UidSearch", reflect.TypeOf((*MockClient)(nil).UidSearch), criteria)
+}
+
+// UidStore mocks base method.
+func (m *MockClient) UidStore(seqset *imap.SeqSet, item imap.StoreItem, value any, ch chan *imap.Message) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UidStore", seqset, item, value, ch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UidStore indicates an expected call of UidStore.
+func (mr *MockClientMockRecorder) UidStore(seqset, item, value, ch any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UidStore", reflect.TypeOf((*MockClient)(nil).UidStore), seqset, item, value, ch)
+}
+
+// Unsubscribe mocks base method.
+func (m *MockClient) Unsubscribe(name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Unsubscribe", name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Unsubscribe indicates an expected call of Unsubscribe.
+func (mr *MockClientMockRecorder) Unsubscribe(name any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unsubscribe", reflect.TypeOf((*MockClient)(nil).Unsubscribe), name)
+}
+
 // MockService is a mock of Service interface.
 type MockService struct {
 	ctrl     *gomock.Controller
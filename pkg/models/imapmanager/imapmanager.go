@@ -5,14 +5,19 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"os"
+	"sort"
+	"time"
 
 	"aaronromeo.com/postmanpat/pkg/base"
 	"aaronromeo.com/postmanpat/pkg/models/mailbox"
 	"aaronromeo.com/postmanpat/pkg/utils"
 	"github.com/emersion/go-imap"
 	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
 	"github.com/pkg/errors"
 )
 
@@ -22,21 +27,29 @@ type ImapManager interface {
 }
 
 type ImapManagerImpl struct {
-	client      base.Client
-	dialTLS     func(address string, tlsConfig *tls.Config) (base.Client, error)
-	Username    string
-	password    string
-	address     string
-	logger      *slog.Logger
-	tlsConfig   *tls.Config
-	ctx         context.Context
-	fileCreator utils.FileManager
+	client         base.Client
+	dialTLS        func(address string, tlsConfig *tls.Config) (base.Client, error)
+	Username       string
+	password       string
+	authzid        string
+	tokenSource    TokenSource
+	address        string
+	logger         *slog.Logger
+	tlsConfig      *tls.Config
+	ctx            context.Context
+	fileCreator    utils.FileManager
+	readOnly       bool
+	redactor       utils.Redactor
+	protectedFlags []string
+	location       *time.Location
+	trace          bool
+	timeouts       Timeouts
 }
 
 type ImapManagerOption func(*ImapManagerImpl) error
 
 func NewImapManager(opts ...ImapManagerOption) (*ImapManagerImpl, error) {
-	var imapMgr ImapManagerImpl
+	imapMgr := ImapManagerImpl{timeouts: DefaultTimeouts}
 	for _, opt := range opts {
 		err := opt(&imapMgr)
 		if err != nil {
@@ -44,22 +57,73 @@ func NewImapManager(opts ...ImapManagerOption) (*ImapManagerImpl, error) {
 		}
 	}
 
+	if err := imapMgr.timeouts.validate(); err != nil {
+		return nil, err
+	}
+
 	if imapMgr.dialTLS == nil {
 		imapMgr.dialTLS = func(address string, tlsConfig *tls.Config) (base.Client, error) {
-			c, err := imapclient.DialTLS(address, tlsConfig)
+			c, err := imapclient.DialWithDialerTLS(&net.Dialer{Timeout: imapMgr.timeouts.Connect}, address, tlsConfig)
 			if err != nil {
 				return nil, err
 			}
+			return &uidplusClient{Client: c}, nil
+		}
+	}
+
+	// Tracing attaches to the go-imap client itself, so it wraps the dialer before the timeout and read-only clients do
+	if imapMgr.trace {
+		dialTLS := imapMgr.dialTLS
+		imapMgr.dialTLS = func(address string, tlsConfig *tls.Config) (base.Client, error) {
+			c, err := dialTLS(address, tlsConfig)
+			if err != nil {
+				return nil, err
+			}
+			if debuggable, ok := c.(interface{ SetDebug(w io.Writer) }); ok {
+				debuggable.SetDebug(newImapTracer(imapMgr.ctx, imapMgr.logger, imapMgr.redactor).debugWriter())
+			}
 			return c, nil
 		}
 	}
 
+	// Timeouts need the go-imap client itself, so a client passed in with WithClient runs without them
+	dialTLS := imapMgr.dialTLS
+	imapMgr.dialTLS = func(address string, tlsConfig *tls.Config) (base.Client, error) {
+		c, err := dialTLS(address, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		if goimapClient, ok := c.(*uidplusClient); ok {
+			return newTimeoutClient(imapMgr.ctx, goimapClient, imapMgr.timeouts), nil
+		}
+		return c, nil
+	}
+
+	if imapMgr.readOnly {
+		dialTLS := imapMgr.dialTLS
+		imapMgr.dialTLS = func(address string, tlsConfig *tls.Config) (base.Client, error) {
+			c, err := dialTLS(address, tlsConfig)
+			if err != nil {
+				return nil, err
+			}
+			return base.NewReadOnlyClient(c), nil
+		}
+
+		if imapMgr.client != nil {
+			imapMgr.client = base.NewReadOnlyClient(imapMgr.client)
+		}
+	}
+
 	if imapMgr.Username == "" {
 		return nil, errors.New("requires username")
 	}
 
-	if imapMgr.password == "" {
-		return nil, errors.New("requires password")
+	if imapMgr.password == "" && imapMgr.tokenSource == nil {
+		return nil, errors.New("requires password or OAuth2 token source")
+	}
+
+	if imapMgr.authzid != "" && imapMgr.tokenSource != nil {
+		return nil, errors.New("an authorization identity can't be combined with OAuth2")
 	}
 
 	if imapMgr.client == nil && imapMgr.address == "" {
@@ -101,6 +165,26 @@ func WithAuth(username string, password string) ImapManagerOption {
 	}
 }
 
+// WithAuthorizationIdentity logs in with the username and password but acts as authzid, so a
+// delegated or admin account can clean another user's or a shared mailbox. The server must
+// support AUTHENTICATE PLAIN and allow the username to act as authzid.
+func WithAuthorizationIdentity(authzid string) ImapManagerOption {
+	return func(imapMgr *ImapManagerImpl) error {
+		imapMgr.authzid = authzid
+		return nil
+	}
+}
+
+// WithOAuth2 logs in with XOAUTH2 access tokens from tokenSource instead of the password, as
+// Gmail and Office 365 require once basic authentication is turned off
+func WithOAuth2(username string, tokenSource TokenSource) ImapManagerOption {
+	return func(imapMgr *ImapManagerImpl) error {
+		imapMgr.Username = username
+		imapMgr.tokenSource = tokenSource
+		return nil
+	}
+}
+
 func WithClient(c base.Client) ImapManagerOption {
 	return func(imapMgr *ImapManagerImpl) error {
 		imapMgr.client = c
@@ -115,6 +199,55 @@ func WithDialTLS(d func(address string, tlsConfig *tls.Config) (base.Client, err
 	}
 }
 
+// WithReadOnly opens every mailbox with EXAMINE and refuses commands that would modify it
+func WithReadOnly(readOnly bool) ImapManagerOption {
+	return func(imapMgr *ImapManagerImpl) error {
+		imapMgr.readOnly = readOnly
+		return nil
+	}
+}
+
+// WithTimeouts bounds connecting and each kind of command on the connections the manager dials
+func WithTimeouts(timeouts Timeouts) ImapManagerOption {
+	return func(imapMgr *ImapManagerImpl) error {
+		imapMgr.timeouts = timeouts
+		return nil
+	}
+}
+
+// WithTrace logs the IMAP protocol exchange of every connection the manager dials, with credentials
+// scrubbed and literals cut short
+func WithTrace(trace bool) ImapManagerOption {
+	return func(imapMgr *ImapManagerImpl) error {
+		imapMgr.trace = trace
+		return nil
+	}
+}
+
+// WithRedactor hides subjects, addresses and bodies in the logs and reports of every mailbox
+func WithRedactor(redactor utils.Redactor) ImapManagerOption {
+	return func(imapMgr *ImapManagerImpl) error {
+		imapMgr.redactor = redactor
+		return nil
+	}
+}
+
+// WithProtectedFlags exempts messages carrying any of the flags or keywords from export and deletion in every mailbox
+func WithProtectedFlags(protectedFlags []string) ImapManagerOption {
+	return func(imapMgr *ImapManagerImpl) error {
+		imapMgr.protectedFlags = protectedFlags
+		return nil
+	}
+}
+
+// WithLocation counts every mailbox's lifespan in the calendar days of the timezone
+func WithLocation(location *time.Location) ImapManagerOption {
+	return func(imapMgr *ImapManagerImpl) error {
+		imapMgr.location = location
+		return nil
+	}
+}
+
 func WithLogger(logger *slog.Logger) ImapManagerOption {
 	// slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	return func(isi *ImapManagerImpl) error {
@@ -143,7 +276,7 @@ func (srv ImapManagerImpl) Login() (base.Client, error) {
 	state := srv.client.State()
 	switch state {
 	case imap.NotAuthenticatedState:
-		if err := srv.client.Login(srv.Username, srv.password); err != nil {
+		if err := srv.authenticate(srv.client); err != nil {
 			srv.logger.ErrorContext(srv.ctx, fmt.Sprintf("Failed to login: %v", err), slog.Any("error", utils.WrapError(err)))
 			return srv.client, err
 		}
@@ -161,7 +294,7 @@ func (srv ImapManagerImpl) Login() (base.Client, error) {
 		srv.client = c
 		srv.logger.Info("Login success")
 
-		if err := srv.client.Login(srv.Username, srv.password); err != nil {
+		if err := srv.authenticate(srv.client); err != nil {
 			srv.logger.ErrorContext(srv.ctx, fmt.Sprintf("Failed to login: %v", err), slog.Any("error", utils.WrapError(err)))
 			return srv.client, err
 		}
@@ -171,6 +304,56 @@ func (srv ImapManagerImpl) Login() (base.Client, error) {
 	return srv.client, nil
 }
 
+// authenticate logs the client in, with AUTHENTICATE PLAIN when acting as another identity or
+// XOAUTH2 when using OAuth2
+func (srv ImapManagerImpl) authenticate(c base.Client) error {
+	if srv.tokenSource != nil {
+		return srv.authenticateOAuth2(c)
+	}
+
+	if srv.authzid == "" {
+		return c.Login(srv.Username, srv.password)
+	}
+
+	ok, err := c.SupportAuth(sasl.Plain)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Errorf("the server doesn't support AUTHENTICATE PLAIN, which is needed to act as %s", srv.authzid)
+	}
+	return c.Authenticate(sasl.NewPlainClient(srv.authzid, srv.Username, srv.password))
+}
+
+// authenticateOAuth2 logs in with an access token, and when the server rejects a cached token,
+// which may have been revoked or expired early, once more with a freshly refreshed one
+func (srv ImapManagerImpl) authenticateOAuth2(c base.Client) error {
+	ok, err := c.SupportAuth(XOAuth2)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Errorf("the server doesn't support AUTHENTICATE %s", XOAuth2)
+	}
+
+	token, err := srv.tokenSource.Token()
+	if err != nil {
+		return err
+	}
+	err = c.Authenticate(newXOAuth2Client(srv.Username, token))
+	if err == nil {
+		return nil
+	}
+
+	srv.logger.WarnContext(srv.ctx, "OAuth2 access token rejected, refreshing it", slog.Any("error", utils.WrapError(err)))
+	srv.tokenSource.Invalidate()
+	token, err = srv.tokenSource.Token()
+	if err != nil {
+		return err
+	}
+	return c.Authenticate(newXOAuth2Client(srv.Username, token))
+}
+
 // Logout
 func (srv ImapManagerImpl) LogoutFn() func() {
 	return func() {
@@ -180,6 +363,15 @@ func (srv ImapManagerImpl) LogoutFn() func() {
 	}
 }
 
+// clientLogoutFn logs out of the client returned by Login, which differs from srv.client after a reconnect
+func (srv ImapManagerImpl) clientLogoutFn(c base.Client) func() {
+	return func() {
+		if err := c.Logout(); err != nil {
+			srv.logger.ErrorContext(srv.ctx, fmt.Sprintf("Failed to logout: %v", err), slog.Any("error", utils.WrapError(err)))
+		}
+	}
+}
+
 // GetMailboxes exports mailboxes from the server to the file system
 func (srv ImapManagerImpl) GetMailboxes() (map[string]*mailbox.MailboxImpl, error) {
 	defer srv.LogoutFn()()
@@ -205,27 +397,95 @@ func (srv ImapManagerImpl) GetMailboxes() (map[string]*mailbox.MailboxImpl, erro
 
 	for m := range mailboxes {
 		srv.logger.Info(fmt.Sprintf("Mailbox: %s", m.Name))
-		if _, ok := serializedMailboxObjs[m.Name]; !ok {
-			verifiedMailboxObjs[m.Name], err = mailbox.NewMailbox(
-				mailbox.WithClient(srv.client),
-				mailbox.WithLogger(srv.logger),
-				mailbox.WithCtx(srv.ctx),
-				mailbox.WithLoginFn(srv.Login),
-				mailbox.WithLogoutFn(srv.client.Logout),
-				mailbox.WithFileManager(utils.OSFileManager{}),
-			)
+		// Settings stored under another form of the name carry over to the name the server lists
+		serializedMailbox := base.SerializedMailbox{
+			Name:       m.Name,
+			Deletable:  false,
+			Exportable: false,
+		}
+		if storedName, ok := base.FindMailboxName(serializedMailboxObjs, m.Name); ok {
+			serializedMailbox = serializedMailboxObjs[storedName].SerializedMailbox
+			serializedMailbox.Name = m.Name
+		}
+		verifiedMailboxObjs[m.Name], err = srv.Mailbox(serializedMailbox)
+		if err != nil {
+			srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+			return nil, err
+		}
+	}
 
-			if err != nil {
-				srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
-				return nil, err
-			}
+	if err := <-done; err != nil {
+		srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return nil, err
+	}
+
+	return verifiedMailboxObjs, err
+}
+
+// Mailbox builds a mailbox bound to this manager's connection from its serialized settings
+func (srv ImapManagerImpl) Mailbox(serializedMailbox base.SerializedMailbox, opts ...mailbox.MailboxOption) (*mailbox.MailboxImpl, error) {
+	if err := serializedMailbox.Validate(); err != nil {
+		return nil, err
+	}
 
-			verifiedMailboxObjs[m.Name].Name = m.Name
-			verifiedMailboxObjs[m.Name].Deletable = false
-			verifiedMailboxObjs[m.Name].Exportable = false
-		} else {
-			verifiedMailboxObjs[m.Name] = serializedMailboxObjs[m.Name]
+	// Login dials a new connection once srv.client is logged out, and that connection isn't kept
+	// by the manager, so the mailbox logs out of whichever client it logged in with
+	var loggedIn base.Client
+	loginFn := func() (base.Client, error) {
+		c, err := srv.Login()
+		if err != nil {
+			return c, err
+		}
+		loggedIn = c
+		return c, nil
+	}
+	logoutFn := func() error {
+		if loggedIn == nil {
+			return nil
 		}
+		c := loggedIn
+		loggedIn = nil
+		return c.Logout()
+	}
+
+	mb, err := mailbox.NewMailbox(append([]mailbox.MailboxOption{
+		mailbox.WithClient(srv.client),
+		mailbox.WithLogger(srv.logger),
+		mailbox.WithCtx(srv.ctx),
+		mailbox.WithLoginFn(loginFn),
+		mailbox.WithLogoutFn(logoutFn),
+		mailbox.WithFileManager(utils.NewInstrumentedFileManager(utils.OSFileManager{}, "os")),
+		mailbox.WithRedactor(srv.redactor),
+		mailbox.WithProtectedFlags(srv.protectedFlags),
+		mailbox.WithLocation(srv.location),
+	}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	mb.SerializedMailbox = serializedMailbox
+
+	return mb, nil
+}
+
+// GetSubscribedMailboxNames lists the mailboxes the user is subscribed to, sorted by name
+func (srv ImapManagerImpl) GetSubscribedMailboxNames() ([]string, error) {
+	c, err := srv.Login()
+	if err != nil {
+		srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return nil, err
+	}
+	defer srv.clientLogoutFn(c)()
+
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Lsub("", "*", mailboxes)
+	}()
+
+	names := []string{}
+	for m := range mailboxes {
+		names = append(names, m.Name)
 	}
 
 	if err := <-done; err != nil {
@@ -233,7 +493,195 @@ func (srv ImapManagerImpl) GetMailboxes() (map[string]*mailbox.MailboxImpl, erro
 		return nil, err
 	}
 
-	return verifiedMailboxObjs, err
+	sort.Strings(names)
+	return names, nil
+}
+
+// ServerMailboxName is the name the server lists for a mailbox named in another form, e.g. typed
+// precomposed when the server holds it decomposed. Commands must be sent the server's name, so a
+// name the server doesn't list is returned as given.
+func (srv ImapManagerImpl) ServerMailboxName(name string) (string, error) {
+	c, err := srv.Login()
+	if err != nil {
+		srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return "", err
+	}
+	defer srv.clientLogoutFn(c)()
+
+	names, err := srv.listMailboxNames(c)
+	if err != nil {
+		return "", err
+	}
+
+	if serverName, ok := base.FindMailboxName(names, name); ok {
+		return serverName, nil
+	}
+	return name, nil
+}
+
+// CreateMailbox creates a mailbox unless the server already lists it, returning whether it was
+// created
+func (srv ImapManagerImpl) CreateMailbox(name string) (bool, error) {
+	c, err := srv.Login()
+	if err != nil {
+		srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return false, err
+	}
+	defer srv.clientLogoutFn(c)()
+
+	names, err := srv.listMailboxNames(c)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := base.FindMailboxName(names, name); ok {
+		return false, nil
+	}
+
+	if err := c.Create(name); err != nil {
+		srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return false, err
+	}
+	srv.logger.Info(fmt.Sprintf("Created mailbox %s", name))
+
+	return true, nil
+}
+
+// listMailboxNames is the set of every mailbox name the server lists
+func (srv ImapManagerImpl) listMailboxNames(c base.Client) (map[string]bool, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", mailboxes)
+	}()
+
+	names := map[string]bool{}
+	for m := range mailboxes {
+		names[m.Name] = true
+	}
+
+	if err := <-done; err != nil {
+		srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return nil, err
+	}
+	return names, nil
+}
+
+// Subscribe adds a mailbox to the user's subscriptions
+func (srv ImapManagerImpl) Subscribe(name string) error {
+	c, err := srv.Login()
+	if err != nil {
+		srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return err
+	}
+	defer srv.clientLogoutFn(c)()
+
+	return c.Subscribe(name)
+}
+
+// Unsubscribe removes a mailbox from the user's subscriptions
+func (srv ImapManagerImpl) Unsubscribe(name string) error {
+	c, err := srv.Login()
+	if err != nil {
+		srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return err
+	}
+	defer srv.clientLogoutFn(c)()
+
+	return c.Unsubscribe(name)
+}
+
+// RenameMailbox renames a mailbox on the server
+func (srv ImapManagerImpl) RenameMailbox(existingName, newName string) error {
+	c, err := srv.Login()
+	if err != nil {
+		srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return err
+	}
+	defer srv.clientLogoutFn(c)()
+
+	if err := c.Rename(existingName, newName); err != nil {
+		srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return err
+	}
+	srv.logger.Info(fmt.Sprintf("Renamed mailbox %s to %s", existingName, newName))
+
+	return nil
+}
+
+// MergeMailbox moves every message in the source mailbox into the destination mailbox, returning
+// the number of messages moved. The emptied source mailbox is left in place
+func (srv ImapManagerImpl) MergeMailbox(sourceName, destName string) (uint32, error) {
+	c, err := srv.Login()
+	if err != nil {
+		srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return 0, err
+	}
+	defer srv.clientLogoutFn(c)()
+
+	mbox, err := c.Select(sourceName, false)
+	if err != nil {
+		srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return 0, err
+	}
+	if mbox.Messages == 0 {
+		srv.logger.Info(fmt.Sprintf("Mailbox %s is empty, nothing to merge", sourceName))
+		return 0, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, mbox.Messages)
+	if err := c.Move(seqSet, destName); err != nil {
+		srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return 0, err
+	}
+	srv.logger.Info(fmt.Sprintf("Moved %d messages from %s to %s", mbox.Messages, sourceName, destName))
+
+	return mbox.Messages, nil
+}
+
+// Capabilities lists the capabilities advertised by the server
+func (srv ImapManagerImpl) Capabilities() (map[string]bool, error) {
+	return srv.client.Capability()
+}
+
+// ProbeResult records how long the server took to answer a search and a fetch
+type ProbeResult struct {
+	Messages      uint32
+	SearchLatency time.Duration
+	FetchLatency  time.Duration
+}
+
+// Probe opens a mailbox read-only, then times a search for every message and a fetch of the newest envelope
+func (srv ImapManagerImpl) Probe(mailboxName string) (ProbeResult, error) {
+	result := ProbeResult{}
+
+	mbox, err := srv.client.Select(mailboxName, true)
+	if err != nil {
+		return result, err
+	}
+	result.Messages = mbox.Messages
+
+	start := time.Now()
+	ids, err := srv.client.Search(imap.NewSearchCriteria())
+	if err != nil {
+		return result, err
+	}
+	result.SearchLatency = time.Since(start)
+
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(ids[len(ids)-1])
+	messages := make(chan *imap.Message, 1)
+	start = time.Now()
+	if err := srv.client.Fetch(seqSet, []imap.FetchItem{imap.FetchEnvelope}, messages); err != nil {
+		return result, err
+	}
+	result.FetchLatency = time.Since(start)
+
+	return result, nil
 }
 
 // unserializeMailboxes reads the mailbox list from the file system and returns a map of mailbox objects
@@ -256,26 +704,14 @@ func (srv ImapManagerImpl) unserializeMailboxes() (map[string]*mailbox.MailboxIm
 	}
 
 	for name, serializedMailbox := range serializedMailboxObjs {
-		mb, err := mailbox.NewMailbox(
-			mailbox.WithClient(srv.client),
-			mailbox.WithLogger(srv.logger),
-			mailbox.WithCtx(srv.ctx),
-			mailbox.WithLoginFn(srv.Login),
-			mailbox.WithLogoutFn(srv.client.Logout),
-			mailbox.WithFileManager(utils.OSFileManager{}),
-		)
+		serializedMailbox.Name = name
+		mb, err := srv.Mailbox(serializedMailbox)
 		if err != nil {
 			srv.logger.ErrorContext(srv.ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
 			return nil, err
 		}
 
-		mb.Name = name
-		mb.Deletable = serializedMailbox.Deletable
-		mb.Exportable = serializedMailbox.Exportable
-		mb.Lifespan = serializedMailbox.Lifespan
-
 		mailboxObjs[name] = mb
-
 	}
 
 	return mailboxObjs, nil
@@ -1,13 +1,23 @@
 package imapmanager
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"aaronromeo.com/postmanpat/pkg/base"
 	"aaronromeo.com/postmanpat/pkg/mock"
+	"aaronromeo.com/postmanpat/pkg/utils"
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-sasl"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/mock/gomock"
@@ -142,6 +152,158 @@ func TestGetMailboxesX(t *testing.T) {
 	assert.Equal(t, expected, actual, "The returned map of mailboxes should match the expected values.")
 }
 
+func TestGetMailboxesKeepsServerNames(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	logger := mock.SetupLogger(t)
+	ctx := context.Background()
+
+	service, err := NewImapManager(
+		WithAuth("foo", "bar"),
+		WithClient(mockClient),
+		WithLogger(logger),
+		WithCtx(ctx),
+		WithFileManager(mock.MockFileWriter{}),
+	)
+	assert.Nil(t, err, "Setup failed")
+
+	// A decomposed name, and a name which only looks like modified UTF-7 because go-imap has
+	// already decoded it, both normalize to "Entwürfe" but are different mailboxes
+	serverNames := []string{"Entwu\u0308rfe", "Entw&APw-rfe"}
+
+	mockClient.EXPECT().State().Return(imap.ConnState(imap.NotAuthenticatedState))
+	mockClient.EXPECT().Login("foo", "bar").Return(nil)
+	mockClient.EXPECT().List("", "*", gomock.Any()).DoAndReturn(func(_, _ string, ch chan *imap.MailboxInfo) error {
+		for _, name := range serverNames {
+			ch <- &imap.MailboxInfo{Name: name}
+		}
+		close(ch)
+		return nil
+	})
+	mockClient.EXPECT().Logout().Return(nil)
+
+	result, err := service.GetMailboxes()
+	assert.NoError(t, err)
+	assert.Len(t, result, len(serverNames))
+
+	for _, name := range serverNames {
+		mb, ok := result[name]
+		if assert.True(t, ok, "mailbox %q is listed", name) {
+			assert.Equal(t, name, mb.Name)
+		}
+
+		// The listed name is the one selected
+		mockClient.EXPECT().Select(name, true).Return(&imap.MailboxStatus{Name: name}, nil)
+		mockClient.EXPECT().Search(gomock.Any()).Return([]uint32{}, nil)
+		_, err := service.Probe(mb.Name)
+		assert.NoError(t, err)
+	}
+}
+
+func TestServerMailboxName(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	logger := mock.SetupLogger(t)
+	ctx := context.Background()
+
+	service, err := NewImapManager(
+		WithAuth("foo", "bar"),
+		WithClient(mockClient),
+		WithLogger(logger),
+		WithCtx(ctx),
+		WithFileManager(mock.MockFileWriter{}),
+	)
+	assert.Nil(t, err, "Setup failed")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{name: "exact", input: "Entw&APw-rfe", expected: "Entw&APw-rfe"},
+		{name: "precomposed finds decomposed", input: "Projekte/Übersicht", expected: "Projekte/U\u0308bersicht"},
+		{name: "missing is kept", input: "Archive", expected: "Archive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient.EXPECT().State().Return(imap.ConnState(imap.AuthenticatedState))
+			mockClient.EXPECT().List("", "*", gomock.Any()).DoAndReturn(func(_, _ string, ch chan *imap.MailboxInfo) error {
+				ch <- &imap.MailboxInfo{Name: "INBOX"}
+				ch <- &imap.MailboxInfo{Name: "Entw&APw-rfe"}
+				ch <- &imap.MailboxInfo{Name: "Projekte/U\u0308bersicht"}
+				close(ch)
+				return nil
+			})
+			mockClient.EXPECT().Logout().Return(nil)
+
+			name, err := service.ServerMailboxName(tt.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, name)
+		})
+	}
+}
+
+func TestCreateMailbox(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	logger := mock.SetupLogger(t)
+	ctx := context.Background()
+
+	service, err := NewImapManager(
+		WithAuth("foo", "bar"),
+		WithClient(mockClient),
+		WithLogger(logger),
+		WithCtx(ctx),
+		WithFileManager(mock.MockFileWriter{}),
+	)
+	assert.Nil(t, err, "Setup failed")
+
+	listMailboxes := func(_, _ string, ch chan *imap.MailboxInfo) error {
+		ch <- &imap.MailboxInfo{Name: "INBOX"}
+		ch <- &imap.MailboxInfo{Name: "PostmanPat/Quarantine"}
+		close(ch)
+		return nil
+	}
+
+	t.Run("creates a missing mailbox", func(t *testing.T) {
+		mockClient.EXPECT().State().Return(imap.ConnState(imap.AuthenticatedState))
+		mockClient.EXPECT().List("", "*", gomock.Any()).DoAndReturn(listMailboxes)
+		mockClient.EXPECT().Create("PostmanPat/Archive").Return(nil)
+		mockClient.EXPECT().Logout().Return(nil)
+
+		created, err := service.CreateMailbox("PostmanPat/Archive")
+		assert.NoError(t, err)
+		assert.True(t, created)
+	})
+
+	t.Run("leaves an existing mailbox", func(t *testing.T) {
+		mockClient.EXPECT().State().Return(imap.ConnState(imap.AuthenticatedState))
+		mockClient.EXPECT().List("", "*", gomock.Any()).DoAndReturn(listMailboxes)
+		mockClient.EXPECT().Logout().Return(nil)
+
+		created, err := service.CreateMailbox("PostmanPat/Quarantine")
+		assert.NoError(t, err)
+		assert.False(t, created)
+	})
+
+	t.Run("returns the create error", func(t *testing.T) {
+		mockClient.EXPECT().State().Return(imap.ConnState(imap.AuthenticatedState))
+		mockClient.EXPECT().List("", "*", gomock.Any()).DoAndReturn(listMailboxes)
+		mockClient.EXPECT().Create("PostmanPat/Archive").Return(errors.New("permission denied"))
+		mockClient.EXPECT().Logout().Return(nil)
+
+		_, err := service.CreateMailbox("PostmanPat/Archive")
+		assert.Error(t, err)
+	})
+}
+
 func TestGetMailboxesErrorHandling(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -290,6 +452,153 @@ func TestLogin(t *testing.T) {
 	}
 }
 
+func TestLoginWithAuthorizationIdentity(t *testing.T) {
+	tests := []struct {
+		name          string
+		supportsPlain bool
+		wantErr       bool
+	}{
+		{name: "Server supports PLAIN", supportsPlain: true},
+		{name: "Server lacks PLAIN", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockClient := mock.NewMockClient(ctrl)
+			service, err := NewImapManager(
+				WithClient(mockClient),
+				WithAuth("admin", "adminpass"),
+				WithAuthorizationIdentity("team@example.com"),
+				WithLogger(mock.SetupLogger(t)),
+				WithCtx(context.Background()),
+				WithFileManager(mock.MockFileWriter{}),
+			)
+			assert.Nil(t, err, "Setup failed")
+
+			mockClient.EXPECT().State().Return(imap.NotAuthenticatedState)
+			mockClient.EXPECT().SupportAuth(sasl.Plain).Return(tt.supportsPlain, nil)
+			if tt.supportsPlain {
+				mockClient.EXPECT().Authenticate(gomock.Any()).DoAndReturn(func(auth sasl.Client) error {
+					mech, ir, err := auth.Start()
+					assert.NoError(t, err)
+					assert.Equal(t, sasl.Plain, mech)
+					assert.Equal(t, "team@example.com\x00admin\x00adminpass", string(ir))
+					return nil
+				})
+			}
+
+			_, err = service.Login()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// staticTokenSource hands out tokens in order, counting invalidations
+type staticTokenSource struct {
+	tokens      []string
+	invalidated int
+}
+
+func (ts *staticTokenSource) Token() (string, error) {
+	return ts.tokens[ts.invalidated], nil
+}
+
+func (ts *staticTokenSource) Invalidate() {
+	ts.invalidated++
+}
+
+func TestLoginWithOAuth2(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	tokenSource := &staticTokenSource{tokens: []string{"revoked", "fresh"}}
+	service, err := NewImapManager(
+		WithClient(mockClient),
+		WithOAuth2("superman@example.com", tokenSource),
+		WithLogger(mock.SetupLogger(t)),
+		WithCtx(context.Background()),
+		WithFileManager(mock.MockFileWriter{}),
+	)
+	assert.Nil(t, err, "Setup failed")
+
+	var sent []string
+	mockClient.EXPECT().State().Return(imap.NotAuthenticatedState)
+	mockClient.EXPECT().SupportAuth(XOAuth2).Return(true, nil)
+	mockClient.EXPECT().Authenticate(gomock.Any()).Times(2).DoAndReturn(func(auth sasl.Client) error {
+		mech, ir, err := auth.Start()
+		assert.NoError(t, err)
+		assert.Equal(t, XOAuth2, mech)
+		sent = append(sent, string(ir))
+		if len(sent) == 1 {
+			return errors.New("AUTHENTICATE failed")
+		}
+		return nil
+	})
+
+	_, err = service.Login()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, tokenSource.invalidated)
+	assert.Equal(t, []string{
+		"user=superman@example.com\x01auth=Bearer revoked\x01\x01",
+		"user=superman@example.com\x01auth=Bearer fresh\x01\x01",
+	}, sent)
+}
+
+func TestRefreshTokenSource(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "refresh_token", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "client-id", r.PostForm.Get("client_id"))
+		assert.Equal(t, "client-secret", r.PostForm.Get("client_secret"))
+		if r.PostForm.Get("refresh_token") != "refresh-token" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`) //nolint:errcheck
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"access-%d","expires_in":3600,"token_type":"Bearer"}`, requests) //nolint:errcheck
+	}))
+	defer server.Close()
+
+	now := time.Date(2024, 5, 10, 6, 0, 0, 0, time.UTC)
+	ts := NewRefreshTokenSource(context.Background(), "client-id", "client-secret", "refresh-token", server.URL)
+	ts.now = func() time.Time { return now }
+
+	token, err := ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "access-1", token)
+
+	// Cached until shortly before it expires
+	now = now.Add(58 * time.Minute)
+	token, err = ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "access-1", token)
+
+	now = now.Add(time.Minute)
+	token, err = ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "access-2", token)
+
+	ts.Invalidate()
+	token, err = ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "access-3", token)
+
+	ts.RefreshToken = "revoked"
+	ts.Invalidate()
+	_, err = ts.Token()
+	assert.ErrorContains(t, err, "invalid_grant")
+}
+
 func TestLogoutFn(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -314,3 +623,375 @@ func TestLogoutFn(t *testing.T) {
 	logoutFunc := service.LogoutFn()
 	logoutFunc() // this should call Logout on the client
 }
+
+func TestMailboxLogsOutOfItsOwnConnection(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// The manager's own client was logged out earlier, so each mailbox dials a connection
+	loggedOutClient := mock.NewMockClient(ctrl)
+	loggedOutClient.EXPECT().State().DoAndReturn(func() imap.ConnState {
+		return imap.LogoutState
+	}).AnyTimes()
+
+	dialed := []*mock.MockClient{}
+	mockDialer := func(address string, tlsConfig *tls.Config) (base.Client, error) {
+		c := mock.NewMockClient(ctrl)
+		c.EXPECT().Login("testuser", "testpass").Return(nil)
+		c.EXPECT().Select(gomock.Any(), false).DoAndReturn(func(name string, _ bool) (*imap.MailboxStatus, error) {
+			return &imap.MailboxStatus{Name: name}, nil
+		})
+		c.EXPECT().Search(gomock.Any()).Return([]uint32{}, nil)
+		// Every dialed connection is logged out once its mailbox is done with it
+		c.EXPECT().Logout().Return(nil)
+		dialed = append(dialed, c)
+		return c, nil
+	}
+
+	service, err := NewImapManager(
+		WithClient(loggedOutClient),
+		WithDialTLS(mockDialer),
+		WithAuth("testuser", "testpass"),
+		WithLogger(mock.SetupLogger(t)),
+		WithCtx(context.Background()),
+		WithFileManager(mock.MockFileWriter{}),
+	)
+	assert.Nil(t, err, "Setup failed")
+
+	for _, name := range []string{"INBOX", "Archive"} {
+		mb, err := service.Mailbox(base.SerializedMailbox{Name: name, Deletable: true, Lifespan: 30})
+		assert.NoError(t, err)
+		assert.NoError(t, mb.ProcessMailbox())
+	}
+
+	assert.Len(t, dialed, 2)
+}
+
+func TestReadOnly(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	logger := mock.SetupLogger(t)
+	ctx := context.Background()
+
+	service, err := NewImapManager(
+		WithClient(mockClient),
+		WithAuth("testuser", "testpass"),
+		WithLogger(logger),
+		WithCtx(ctx),
+		WithFileManager(mock.MockFileWriter{}),
+		WithReadOnly(true),
+	)
+	assert.Nil(t, err, "Setup failed")
+
+	// Select is always issued as EXAMINE
+	mockClient.EXPECT().Select("INBOX", true).Return(&imap.MailboxStatus{Name: "INBOX"}, nil)
+	_, err = service.client.Select("INBOX", false)
+	assert.NoError(t, err)
+
+	// Mutating commands never reach the underlying client
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(1)
+	err = service.client.Store(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil)
+	assert.ErrorIs(t, err, base.ErrReadOnly)
+
+	err = service.client.Expunge(nil)
+	assert.ErrorIs(t, err, base.ErrReadOnly)
+
+	err = service.client.Move(seqSet, "Archive")
+	assert.ErrorIs(t, err, base.ErrReadOnly)
+
+	err = service.client.Rename("INBOX", "Archive")
+	assert.ErrorIs(t, err, base.ErrReadOnly)
+}
+
+func TestReadOnlyRefusesSubscriptions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	logger := mock.SetupLogger(t)
+	ctx := context.Background()
+
+	service, err := NewImapManager(
+		WithClient(mockClient),
+		WithAuth("testuser", "testpass"),
+		WithLogger(logger),
+		WithCtx(ctx),
+		WithFileManager(mock.MockFileWriter{}),
+		WithReadOnly(true),
+	)
+	assert.Nil(t, err, "Setup failed")
+
+	// Subscriptions change the server's state, so they never reach the underlying client either
+	err = service.client.Subscribe("Archive")
+	assert.ErrorIs(t, err, base.ErrReadOnly)
+
+	err = service.client.Unsubscribe("Archive")
+	assert.ErrorIs(t, err, base.ErrReadOnly)
+}
+
+func TestProbe(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	logger := mock.SetupLogger(t)
+	ctx := context.Background()
+
+	service, err := NewImapManager(
+		WithClient(mockClient),
+		WithAuth("testuser", "testpass"),
+		WithLogger(logger),
+		WithCtx(ctx),
+		WithFileManager(mock.MockFileWriter{}),
+	)
+	assert.Nil(t, err, "Setup failed")
+
+	mockClient.EXPECT().Select("INBOX", true).Return(&imap.MailboxStatus{Name: "INBOX", Messages: 3}, nil)
+	mockClient.EXPECT().Search(gomock.Any()).Return([]uint32{1, 2, 3}, nil)
+
+	// Only the newest message is fetched
+	newest := new(imap.SeqSet)
+	newest.AddNum(3)
+	mockClient.EXPECT().Fetch(newest, []imap.FetchItem{imap.FetchEnvelope}, gomock.Any()).DoAndReturn(
+		func(_ *imap.SeqSet, _ []imap.FetchItem, ch chan *imap.Message) error {
+			close(ch)
+			return nil
+		},
+	)
+
+	result, err := service.Probe("INBOX")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), result.Messages)
+}
+
+func TestGetSubscribedMailboxNames(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	logger := mock.SetupLogger(t)
+	ctx := context.Background()
+
+	service, err := NewImapManager(
+		WithClient(mockClient),
+		WithAuth("testuser", "testpass"),
+		WithLogger(logger),
+		WithCtx(ctx),
+		WithFileManager(mock.MockFileWriter{}),
+	)
+	assert.Nil(t, err, "Setup failed")
+
+	mockClient.EXPECT().State().Return(imap.NotAuthenticatedState)
+	mockClient.EXPECT().Login("testuser", "testpass").Return(nil)
+	mockClient.EXPECT().Lsub("", "*", gomock.Any()).DoAndReturn(func(_, _ string, ch chan *imap.MailboxInfo) error {
+		ch <- &imap.MailboxInfo{Name: "Work"}
+		ch <- &imap.MailboxInfo{Name: "INBOX"}
+		close(ch)
+		return nil
+	})
+	mockClient.EXPECT().Logout().Return(nil)
+
+	names, err := service.GetSubscribedMailboxNames()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"INBOX", "Work"}, names)
+}
+
+func TestMergeMailbox(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	logger := mock.SetupLogger(t)
+	ctx := context.Background()
+
+	service, err := NewImapManager(
+		WithClient(mockClient),
+		WithAuth("testuser", "testpass"),
+		WithLogger(logger),
+		WithCtx(ctx),
+		WithFileManager(mock.MockFileWriter{}),
+	)
+	assert.Nil(t, err, "Setup failed")
+
+	t.Run("moves every message", func(t *testing.T) {
+		mockClient.EXPECT().State().Return(imap.ConnState(imap.AuthenticatedState))
+		mockClient.EXPECT().Select("Old", false).Return(&imap.MailboxStatus{Name: "Old", Messages: 4}, nil)
+		all := new(imap.SeqSet)
+		all.AddRange(1, 4)
+		mockClient.EXPECT().Move(all, "Archive").Return(nil)
+		mockClient.EXPECT().Logout().Return(nil)
+
+		moved, err := service.MergeMailbox("Old", "Archive")
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(4), moved)
+	})
+
+	t.Run("skips an empty mailbox", func(t *testing.T) {
+		mockClient.EXPECT().State().Return(imap.ConnState(imap.AuthenticatedState))
+		mockClient.EXPECT().Select("Old", false).Return(&imap.MailboxStatus{Name: "Old"}, nil)
+		mockClient.EXPECT().Logout().Return(nil)
+
+		moved, err := service.MergeMailbox("Old", "Archive")
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(0), moved)
+	})
+
+	t.Run("returns the move error", func(t *testing.T) {
+		mockClient.EXPECT().State().Return(imap.ConnState(imap.AuthenticatedState))
+		mockClient.EXPECT().Select("Old", false).Return(&imap.MailboxStatus{Name: "Old", Messages: 1}, nil)
+		mockClient.EXPECT().Move(gomock.Any(), "Missing").Return(errors.New("no such mailbox"))
+		mockClient.EXPECT().Logout().Return(nil)
+
+		_, err := service.MergeMailbox("Old", "Missing")
+		assert.Error(t, err)
+	})
+}
+
+func TestImapTracer(t *testing.T) {
+	tests := []struct {
+		name      string
+		redactor  utils.Redactor
+		client    []string
+		server    []string
+		wantLines []string
+	}{
+		{
+			name:      "scrubs login",
+			client:    []string{"a1 LOGIN superman clarkkent\r\n"},
+			server:    []string{"a1 OK LOGIN completed\r\n"},
+			wantLines: []string{"C a1 LOGIN [redacted]", "S a1 OK LOGIN completed"},
+		},
+		{
+			name:      "scrubs the SASL exchange",
+			client:    []string{"a1 AUTHENTICATE PLAIN\r\n", "AHN1cGVybWFuAGNsYXJra2VudA==\r\n"},
+			server:    []string{"+ \r\n", "a1 OK\r\n"},
+			wantLines: []string{"C a1 AUTHENTICATE PLAIN", "C [redacted]", "S + ", "S a1 OK"},
+		},
+		{
+			name:      "scrubs a SASL initial response",
+			client:    []string{"a1 AUTHENTICATE XOAUTH2 dXNlcj1zdXBlcm1hbgFhdXRoPUJlYXJlciB0b2tlbgEB\r\n"},
+			server:    []string{"a1 OK\r\n"},
+			wantLines: []string{"C a1 AUTHENTICATE XOAUTH2 [redacted]", "S a1 OK"},
+		},
+		{
+			name:      "never shows client literals",
+			client:    []string{"a1 LOGIN superman {9}\r\n", "clarkkent\r\n"},
+			wantLines: []string{"C a1 LOGIN [redacted]", "C [literal 9 bytes]", "C "},
+		},
+		{
+			name:      "previews server literals split across writes",
+			server:    []string{"* 1 FETCH (BODY[] {11}\r\nHello", " world)\r\n"},
+			wantLines: []string{"S * 1 FETCH (BODY[] {11}", `S [literal 11 bytes] "Hello world"...`, "S )"},
+		},
+		{
+			name:      "redacts quoted strings and literals",
+			redactor:  utils.Redactor{Mode: utils.RedactTruncate},
+			server:    []string{"* 1 FETCH (ENVELOPE (\"Mon, 1 Jan 2024\" \"Quarterly report\") BODY[] {5}\r\nHello)\r\n"},
+			wantLines: []string{`S * 1 FETCH (ENVELOPE ("Mon,..." "Quar...") BODY[] {5}`, "S [literal 5 bytes]", "S )"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, nil))
+			tracer := newImapTracer(context.Background(), logger, tc.redactor)
+			client := &traceWriter{tracer: tracer, direction: "C"}
+			server := &traceWriter{tracer: tracer, direction: "S"}
+
+			// Interleave the two sides the way a conversation goes
+			for i := 0; i < len(tc.client) || i < len(tc.server); i++ {
+				if i < len(tc.client) {
+					_, err := client.Write([]byte(tc.client[i]))
+					assert.NoError(t, err)
+				}
+				if i < len(tc.server) {
+					_, err := server.Write([]byte(tc.server[i]))
+					assert.NoError(t, err)
+				}
+			}
+
+			gotLines := []string{}
+			decoder := json.NewDecoder(&buf)
+			for decoder.More() {
+				var record struct {
+					Direction string `json:"direction"`
+					Line      string `json:"line"`
+				}
+				assert.NoError(t, decoder.Decode(&record))
+				gotLines = append(gotLines, record.Direction+" "+record.Line)
+			}
+			assert.ElementsMatch(t, tc.wantLines, gotLines)
+		})
+	}
+}
+
+func TestTimeoutClient(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	timeouts := Timeouts{Command: time.Minute, Search: 2 * time.Minute, Fetch: 10 * time.Minute}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	current := timeouts.Command
+	c := &timeoutClient{
+		Client:     mockClient,
+		ctx:        ctx,
+		timeouts:   timeouts,
+		setTimeout: func(timeout time.Duration) { current = timeout },
+	}
+
+	// Search and fetch run under their own timeouts and restore the command default
+	mockClient.EXPECT().Search(gomock.Any()).DoAndReturn(func(_ *imap.SearchCriteria) ([]uint32, error) {
+		assert.Equal(t, timeouts.Search, current)
+		return []uint32{1}, nil
+	})
+	_, err := c.Search(imap.NewSearchCriteria())
+	assert.NoError(t, err)
+	assert.Equal(t, timeouts.Command, current)
+
+	mockClient.EXPECT().Fetch(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(_ *imap.SeqSet, _ []imap.FetchItem, ch chan *imap.Message) error {
+		assert.Equal(t, timeouts.Fetch, current)
+		close(ch)
+		return nil
+	})
+	assert.NoError(t, c.Fetch(new(imap.SeqSet), nil, make(chan *imap.Message)))
+	assert.Equal(t, timeouts.Command, current)
+
+	// Nothing is sent once the context is done
+	cancel()
+	_, err = c.Search(imap.NewSearchCriteria())
+	assert.ErrorIs(t, err, context.Canceled)
+
+	messages := make(chan *imap.Message)
+	assert.ErrorIs(t, c.Fetch(new(imap.SeqSet), nil, messages), context.Canceled)
+	_, open := <-messages
+	assert.False(t, open, "Fetch should close the channel it was given")
+
+	_, err = NewImapManager(
+		WithClient(mockClient),
+		WithAuth("testuser", "testpass"),
+		WithLogger(mock.SetupLogger(t)),
+		WithFileManager(mock.MockFileWriter{}),
+		WithTimeouts(Timeouts{Fetch: -time.Second}),
+	)
+	assert.Error(t, err)
+}
+
+func TestUidExpungeCommand(t *testing.T) {
+	uids := new(imap.SeqSet)
+	uids.AddNum(40, 41, 42, 97)
+
+	cmd := (&commands.Uid{Cmd: &uidExpunge{SeqSet: uids}}).Command()
+	cmd.Tag = "A1"
+
+	var buf bytes.Buffer
+	w := imap.NewWriter(&buf)
+	assert.NoError(t, cmd.WriteTo(w))
+	assert.NoError(t, w.Flush())
+	assert.Equal(t, "A1 UID EXPUNGE 40:42,97\r\n", buf.String())
+}
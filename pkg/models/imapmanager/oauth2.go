@@ -0,0 +1,166 @@
+package imapmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/pkg/errors"
+)
+
+// XOAuth2 is the SASL mechanism Gmail and Office 365 use for OAuth2 access tokens
+const XOAuth2 = "XOAUTH2"
+
+// tokenExpiryMargin refreshes an access token this long before it expires, so it doesn't lapse
+// between being handed out and being sent
+const tokenExpiryMargin = time.Minute
+
+// TokenSource hands out OAuth2 access tokens
+type TokenSource interface {
+	// Token returns an access token which is valid now
+	Token() (string, error)
+	// Invalidate drops a cached token the server rejected, so the next Token fetches a new one
+	Invalidate()
+}
+
+// RefreshTokenSource exchanges a long lived refresh token for access tokens at the provider's
+// token endpoint, caching each access token until shortly before it expires
+type RefreshTokenSource struct {
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	// TokenURL is the provider's token endpoint, e.g. https://oauth2.googleapis.com/token
+	TokenURL   string
+	HTTPClient *http.Client
+	Ctx        context.Context
+
+	mu          sync.Mutex
+	accessToken string
+	expiry      time.Time
+	now         func() time.Time
+}
+
+func NewRefreshTokenSource(ctx context.Context, clientID, clientSecret, refreshToken, tokenURL string) *RefreshTokenSource {
+	return &RefreshTokenSource{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RefreshToken: refreshToken,
+		TokenURL:     tokenURL,
+		HTTPClient:   &http.Client{Timeout: 30 * time.Second},
+		Ctx:          ctx,
+		now:          time.Now,
+	}
+}
+
+func (ts *RefreshTokenSource) Token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.accessToken != "" && ts.now().Add(tokenExpiryMargin).Before(ts.expiry) {
+		return ts.accessToken, nil
+	}
+
+	accessToken, expiresIn, err := ts.refresh()
+	if err != nil {
+		return "", err
+	}
+	ts.accessToken = accessToken
+	ts.expiry = ts.now().Add(expiresIn)
+	return ts.accessToken, nil
+}
+
+func (ts *RefreshTokenSource) Invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.accessToken = ""
+}
+
+// refresh asks the token endpoint for a new access token
+func (ts *RefreshTokenSource) refresh() (string, time.Duration, error) {
+	ctx := ts.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {ts.ClientID},
+		"refresh_token": {ts.RefreshToken},
+	}
+	if ts.ClientSecret != "" {
+		form.Set("client_secret", ts.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := ts.HTTPClient.Do(req)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "refreshing the OAuth2 access token")
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", 0, errors.Wrapf(err, "reading the OAuth2 token response (status %s)", resp.Status)
+	}
+
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		if body.Error != "" {
+			return "", 0, errors.Errorf("refreshing the OAuth2 access token failed: %s %s", body.Error, body.ErrorDescription)
+		}
+		return "", 0, errors.Errorf("refreshing the OAuth2 access token failed with status %s", resp.Status)
+	}
+
+	return body.AccessToken, time.Duration(body.ExpiresIn) * time.Second, nil
+}
+
+// xoauth2Error is the JSON the server sends back as a challenge when it rejects a token
+type xoauth2Error struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes"`
+	Scope   string `json:"scope"`
+}
+
+func (err *xoauth2Error) Error() string {
+	return fmt.Sprintf("XOAUTH2 authentication error (%v)", err.Status)
+}
+
+// xoauth2Client implements the XOAUTH2 SASL mechanism, which go-sasl leaves out
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func newXOAuth2Client(username, token string) sasl.Client {
+	return &xoauth2Client{username: username, token: token}
+}
+
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	return XOAuth2, []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"), nil
+}
+
+// Next is only called when the server rejects the token, its challenge describes why
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	xoauthErr := &xoauth2Error{}
+	if err := json.Unmarshal(challenge, xoauthErr); err != nil {
+		return nil, errors.Wrap(sasl.ErrUnexpectedServerChallenge, string(challenge))
+	}
+	return nil, xoauthErr
+}
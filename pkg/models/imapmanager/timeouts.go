@@ -0,0 +1,171 @@
+package imapmanager
+
+import (
+	"context"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-sasl"
+	"github.com/pkg/errors"
+)
+
+// Timeouts bound how long each kind of IMAP operation may take, zero means no limit
+type Timeouts struct {
+	// Connect covers dialing and the TLS handshake
+	Connect time.Duration
+	// Command is the default for every command without its own timeout
+	Command time.Duration
+	// Search covers a SEARCH, which can be slow on large mailboxes
+	Search time.Duration
+	// Fetch covers a whole FETCH, including downloading every message body
+	Fetch time.Duration
+}
+
+var DefaultTimeouts = Timeouts{
+	Connect: 30 * time.Second,
+	Command: time.Minute,
+	Search:  2 * time.Minute,
+	Fetch:   10 * time.Minute,
+}
+
+func (t Timeouts) validate() error {
+	if t.Connect < 0 || t.Command < 0 || t.Search < 0 || t.Fetch < 0 {
+		return errors.New("timeouts can't be negative")
+	}
+	return nil
+}
+
+// timeoutClient applies the timeout for each operation before it is sent, and refuses to start a
+// command once the context is done. go-imap v1 has no per-call context, its Timeout is a deadline
+// set on the connection at the start of every command.
+type timeoutClient struct {
+	base.Client
+	ctx        context.Context
+	timeouts   Timeouts
+	setTimeout func(time.Duration)
+}
+
+func newTimeoutClient(ctx context.Context, c *uidplusClient, timeouts Timeouts) *timeoutClient {
+	c.Timeout = timeouts.Command
+	return &timeoutClient{
+		Client:     c,
+		ctx:        ctx,
+		timeouts:   timeouts,
+		setTimeout: func(timeout time.Duration) { c.Timeout = timeout },
+	}
+}
+
+func (c *timeoutClient) ctxErr() error {
+	if c.ctx == nil {
+		return nil
+	}
+	return c.ctx.Err()
+}
+
+// withTimeout runs a command under its own timeout, then restores the command default
+func (c *timeoutClient) withTimeout(timeout time.Duration, command func() error) error {
+	c.setTimeout(timeout)
+	defer c.setTimeout(c.timeouts.Command)
+	return command()
+}
+
+func (c *timeoutClient) Login(username, password string) error {
+	if err := c.ctxErr(); err != nil {
+		return err
+	}
+	return c.Client.Login(username, password)
+}
+
+func (c *timeoutClient) Authenticate(auth sasl.Client) error {
+	if err := c.ctxErr(); err != nil {
+		return err
+	}
+	return c.Client.Authenticate(auth)
+}
+
+func (c *timeoutClient) Select(name string, readOnly bool) (*imap.MailboxStatus, error) {
+	if err := c.ctxErr(); err != nil {
+		return nil, err
+	}
+	return c.Client.Select(name, readOnly)
+}
+
+func (c *timeoutClient) Search(criteria *imap.SearchCriteria) (seqNums []uint32, err error) {
+	if err := c.ctxErr(); err != nil {
+		return nil, err
+	}
+	err = c.withTimeout(c.timeouts.Search, func() error {
+		seqNums, err = c.Client.Search(criteria)
+		return err
+	})
+	return seqNums, err
+}
+
+func (c *timeoutClient) Fetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	if err := c.ctxErr(); err != nil {
+		close(ch)
+		return err
+	}
+	return c.withTimeout(c.timeouts.Fetch, func() error {
+		return c.Client.Fetch(seqset, items, ch)
+	})
+}
+
+func (c *timeoutClient) Store(seqset *imap.SeqSet, item imap.StoreItem, value interface{}, ch chan *imap.Message) error {
+	if err := c.ctxErr(); err != nil {
+		if ch != nil {
+			close(ch)
+		}
+		return err
+	}
+	return c.Client.Store(seqset, item, value, ch)
+}
+
+func (c *timeoutClient) Expunge(ch chan uint32) error {
+	if err := c.ctxErr(); err != nil {
+		if ch != nil {
+			close(ch)
+		}
+		return err
+	}
+	return c.Client.Expunge(ch)
+}
+
+func (c *timeoutClient) UidSearch(criteria *imap.SearchCriteria) (uids []uint32, err error) {
+	if err := c.ctxErr(); err != nil {
+		return nil, err
+	}
+	err = c.withTimeout(c.timeouts.Search, func() error {
+		uids, err = c.Client.UidSearch(criteria)
+		return err
+	})
+	return uids, err
+}
+
+func (c *timeoutClient) UidStore(seqset *imap.SeqSet, item imap.StoreItem, value interface{}, ch chan *imap.Message) error {
+	if err := c.ctxErr(); err != nil {
+		if ch != nil {
+			close(ch)
+		}
+		return err
+	}
+	return c.Client.UidStore(seqset, item, value, ch)
+}
+
+func (c *timeoutClient) UidExpunge(seqset *imap.SeqSet, ch chan uint32) error {
+	if err := c.ctxErr(); err != nil {
+		if ch != nil {
+			close(ch)
+		}
+		return err
+	}
+	return c.Client.UidExpunge(seqset, ch)
+}
+
+func (c *timeoutClient) Move(seqset *imap.SeqSet, dest string) error {
+	if err := c.ctxErr(); err != nil {
+		return err
+	}
+	return c.Client.Move(seqset, dest)
+}
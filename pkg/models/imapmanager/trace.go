@@ -0,0 +1,169 @@
+package imapmanager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/utils"
+	"github.com/emersion/go-imap"
+)
+
+const (
+	// traceMaxLineLength caps each logged line, long FETCH responses are cut short
+	traceMaxLineLength = 512
+	// traceLiteralPreview is how much of a server literal is shown when PII isn't redacted
+	traceLiteralPreview = 64
+	// traceLinesPerSecond throttles the trace, lines beyond it are counted and dropped
+	traceLinesPerSecond = 50
+)
+
+var (
+	traceLiteralRe      = regexp.MustCompile(`\{(\d+)\+?\}$`)
+	traceLoginRe        = regexp.MustCompile(`(?i)^(\S+ LOGIN) .*`)
+	traceAuthenticateRe = regexp.MustCompile(`(?i)^(\S+ AUTHENTICATE \S+)(?: .*)?$`)
+	traceQuotedRe       = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+)
+
+// imapTracer logs the IMAP protocol exchange line by line. Credentials are always scrubbed, literals
+// are replaced by their size and, when PII is redacted, quoted strings go through the redactor
+type imapTracer struct {
+	ctx      context.Context
+	logger   *slog.Logger
+	redactor utils.Redactor
+
+	mu             sync.Mutex
+	authenticating bool
+	window         time.Time
+	lines          int
+	dropped        int
+}
+
+func newImapTracer(ctx context.Context, logger *slog.Logger, redactor utils.Redactor) *imapTracer {
+	return &imapTracer{ctx: ctx, logger: logger, redactor: redactor}
+}
+
+// debugWriter is handed to the go-imap client, which writes what it sends and receives to each side
+func (t *imapTracer) debugWriter() io.Writer {
+	return imap.NewDebugWriter(&traceWriter{tracer: t, direction: "C"}, &traceWriter{tracer: t, direction: "S"})
+}
+
+func (t *imapTracer) log(direction, line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.window) >= time.Second {
+		if t.dropped > 0 {
+			t.logger.WarnContext(t.ctx, "IMAP trace throttled", slog.Int("dropped", t.dropped))
+		}
+		t.window, t.lines, t.dropped = now, 0, 0
+	}
+	if t.lines >= traceLinesPerSecond {
+		t.dropped++
+		return
+	}
+	t.lines++
+
+	t.logger.InfoContext(t.ctx, "IMAP trace", slog.String("direction", direction), slog.String("line", t.scrub(direction, line)))
+}
+
+// scrub removes credentials and PII from a single protocol line
+func (t *imapTracer) scrub(direction, line string) string {
+	if direction == "C" {
+		switch {
+		case traceLoginRe.MatchString(line):
+			return traceLoginRe.ReplaceAllString(line, "$1 [redacted]")
+		case traceAuthenticateRe.MatchString(line):
+			// The SASL exchange follows as bare client lines, or with SASL-IR starts after the mechanism
+			t.authenticating = true
+			if command := traceAuthenticateRe.FindStringSubmatch(line)[1]; command != line {
+				return command + " [redacted]"
+			}
+			return line
+		case t.authenticating:
+			return "[redacted]"
+		}
+	} else if t.authenticating && !strings.HasPrefix(line, "+") {
+		t.authenticating = false
+	}
+
+	if t.redactor.Mode != utils.RedactNone {
+		line = traceQuotedRe.ReplaceAllStringFunc(line, func(quoted string) string {
+			return strconv.Quote(t.redactor.Redact(quoted[1 : len(quoted)-1]))
+		})
+	}
+
+	if len(line) > traceMaxLineLength {
+		line = fmt.Sprintf("%s... (+%d bytes)", line[:traceMaxLineLength], len(line)-traceMaxLineLength)
+	}
+	return line
+}
+
+// traceWriter splits one direction of the stream into lines and skips over literals
+type traceWriter struct {
+	tracer    *imapTracer
+	direction string
+
+	line             []byte
+	literalSize      int
+	literalRemaining int
+	literalPreview   []byte
+}
+
+func (w *traceWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if w.literalRemaining > 0 {
+			chunk := p
+			if len(chunk) > w.literalRemaining {
+				chunk = chunk[:w.literalRemaining]
+			}
+			if room := traceLiteralPreview - len(w.literalPreview); room > 0 {
+				w.literalPreview = append(w.literalPreview, chunk[:min(room, len(chunk))]...)
+			}
+			w.literalRemaining -= len(chunk)
+			p = p[len(chunk):]
+
+			if w.literalRemaining == 0 {
+				w.tracer.log(w.direction, w.literalSummary())
+				w.literalPreview = nil
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.line = append(w.line, p...)
+			break
+		}
+
+		w.line = append(w.line, p[:i]...)
+		p = p[i+1:]
+		line := string(bytes.TrimRight(w.line, "\r"))
+		w.line = w.line[:0]
+
+		w.tracer.log(w.direction, line)
+		if match := traceLiteralRe.FindStringSubmatch(line); match != nil {
+			if size, err := strconv.Atoi(match[1]); err == nil && size > 0 {
+				w.literalSize, w.literalRemaining = size, size
+			}
+		}
+	}
+	return n, nil
+}
+
+// literalSummary stands in for a literal, client literals can hold passwords so only servers' are previewed
+func (w *traceWriter) literalSummary() string {
+	if w.direction == "C" || w.tracer.redactor.Mode != utils.RedactNone {
+		return fmt.Sprintf("[literal %d bytes]", w.literalSize)
+	}
+	return fmt.Sprintf("[literal %d bytes] %q...", w.literalSize, w.literalPreview)
+}
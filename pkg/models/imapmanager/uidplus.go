@@ -0,0 +1,50 @@
+package imapmanager
+
+import (
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// uidplusClient is the go-imap client with UID EXPUNGE from UIDPLUS (RFC 4315), which go-imap v1
+// only has in a separate extension
+type uidplusClient struct {
+	*imapclient.Client
+}
+
+// uidExpunge is the EXPUNGE command UID wraps into UID EXPUNGE
+type uidExpunge struct {
+	SeqSet *imap.SeqSet
+}
+
+func (cmd *uidExpunge) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "EXPUNGE",
+		Arguments: []interface{}{cmd.SeqSet},
+	}
+}
+
+// UidExpunge removes the messages in the UID set which are flagged \Deleted, leaving any other
+// message flagged \Deleted in place. The server must support UIDPLUS. Like Expunge, the sequence
+// numbers of the removed messages are sent on ch, which is closed once the command completes.
+func (c *uidplusClient) UidExpunge(seqset *imap.SeqSet, ch chan uint32) error {
+	if ch != nil {
+		defer close(ch)
+	}
+
+	if c.State() != imap.SelectedState {
+		return imapclient.ErrNoMailboxSelected
+	}
+
+	var h responses.Handler
+	if ch != nil {
+		h = &responses.Expunge{SeqNums: ch}
+	}
+
+	status, err := c.Execute(&commands.Uid{Cmd: &uidExpunge{SeqSet: seqset}}, h)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
@@ -5,8 +5,7 @@ import (
 	"io"
 	"log/slog"
 	"os"
-	"path/filepath"
-	"regexp"
+	"path"
 	"strings"
 	"time"
 
@@ -70,40 +69,42 @@ type ExportedEmailContainer struct {
 	msgBodyPartSpecifier string
 }
 
-func (e ExportedEmailContainer) WriteToFile(mlogger *slog.Logger, fileManager utils.FileManager, emailFolderPath string) error {
+func (e ExportedEmailContainer) WriteToFile(mlogger *slog.Logger, redactor utils.Redactor, fileManager utils.FileManager, emailFolderPath string) error {
 	// Save email body
-	bodyFilename := filepath.Join(emailFolderPath, fmt.Sprintf("body_%d.%s", e.msgBodyPartPosition, getExtension(e.msgBodyContentType)))
+	bodyFilename := path.Join(emailFolderPath, fmt.Sprintf("body_%d.%s", e.msgBodyPartPosition, getExtension(e.msgBodyContentType)))
 	writer, err := fileManager.Create(bodyFilename)
 	if err != nil {
+		err = redactor.RedactError(err, emailFolderPath)
 		mlogger.Error("Failed to create body file", slog.Any("error", err))
 		return err
 	}
 
 	_, err = writer.Write(e.msgBody)
 	if err != nil {
+		writer.Close() //nolint:errcheck
+		err = redactor.RedactError(err, emailFolderPath)
 		mlogger.Error(
 			err.Error(),
 			slog.Any("error", utils.WrapError(err)),
-			slog.Any("fileName", bodyFilename),
-			slog.Any("buffer", e.msgBody),
+			slog.Any("fileName", redactor.Redact(bodyFilename)),
+			slog.Any("buffer", redactor.RedactBytes(e.msgBody)),
 		)
 		return err
 	}
 
-	if err = writer.Flush(); err != nil {
-		mlogger.Error(err.Error(), slog.Any("error", utils.WrapError(err)))
-	}
-
-	if err != nil {
-		mlogger.Error("Failed to write body file", slog.Any("error", err))
+	// The body file is only complete once closed
+	if err = writer.Close(); err != nil {
+		err = redactor.RedactError(err, emailFolderPath)
+		mlogger.Error("Failed to write body file", slog.Any("error", utils.WrapError(err)))
 		return err
 	}
 
 	// Save attachments (if any)
 	if len(e.extractedFileName) > 0 {
-		attachmentFile := filepath.Join(emailFolderPath, sanitize(e.extractedFileName))
+		attachmentFile := path.Join(emailFolderPath, sanitize(e.extractedFileName))
 		err = fileManager.WriteFile(attachmentFile, e.msgBody, os.ModePerm)
 		if err != nil {
+			err = redactor.RedactError(err, emailFolderPath)
 			mlogger.Error("Failed to write attachment file", slog.Any("error", err))
 			return err
 		}
@@ -112,6 +113,15 @@ func (e ExportedEmailContainer) WriteToFile(mlogger *slog.Logger, fileManager ut
 	return nil
 }
 
+// writtenSize is the number of bytes WriteToFile sends to storage
+func (e ExportedEmailContainer) writtenSize() int64 {
+	size := int64(len(e.msgBody))
+	if len(e.extractedFileName) > 0 {
+		size += int64(len(e.msgBody))
+	}
+	return size
+}
+
 func getExtension(contentType string) string {
 	switch contentType {
 	case "text/html":
@@ -140,15 +150,79 @@ func getExtension(contentType string) string {
 	}
 }
 
-func sanitize(input string) string {
-	illegalCharsRe := regexp.MustCompile(`[^a-zA-Z0-9\-_]`)
-	return illegalCharsRe.ReplaceAllString(input, "_")
+// ParseLimits bounds the work done parsing a single message body so a hostile
+// message can't exhaust memory
+type ParseLimits struct {
+	// MaxDepth is the deepest multipart nesting which is followed
+	MaxDepth int
+	// MaxParts is the number of parts allowed across the whole message
+	MaxParts int
+	// MaxPartSize is the largest decoded size allowed for a single part
+	MaxPartSize int64
+	// MaxTotalSize is the largest decoded size allowed across all parts
+	MaxTotalSize int64
+}
+
+var DefaultParseLimits = ParseLimits{
+	MaxDepth:     10,
+	MaxParts:     500,
+	MaxPartSize:  25 << 20,
+	MaxTotalSize: 100 << 20,
+}
+
+var ErrParseLimitExceeded = errors.New("message exceeds parse limits")
+
+// withDefaults fills any unset limit from DefaultParseLimits
+func (pl ParseLimits) withDefaults() ParseLimits {
+	if pl.MaxDepth <= 0 {
+		pl.MaxDepth = DefaultParseLimits.MaxDepth
+	}
+	if pl.MaxParts <= 0 {
+		pl.MaxParts = DefaultParseLimits.MaxParts
+	}
+	if pl.MaxPartSize <= 0 {
+		pl.MaxPartSize = DefaultParseLimits.MaxPartSize
+	}
+	if pl.MaxTotalSize <= 0 {
+		pl.MaxTotalSize = DefaultParseLimits.MaxTotalSize
+	}
+	return pl
+}
+
+// parseState tracks the running totals checked against the ParseLimits
+type parseState struct {
+	limits    ParseLimits
+	partCount int
+	totalSize int64
 }
 
-func ExportedEmailContainerFactory(mailboxName string, msg *imap.Message) ([]ExportedEmailContainer, error) {
+func (ps *parseState) readBody(body io.Reader) ([]byte, error) {
+	ps.partCount++
+	if ps.partCount > ps.limits.MaxParts {
+		return nil, errors.Wrapf(ErrParseLimitExceeded, "more than %d parts", ps.limits.MaxParts)
+	}
+
+	messageBody, err := io.ReadAll(io.LimitReader(body, ps.limits.MaxPartSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(messageBody)) > ps.limits.MaxPartSize {
+		return nil, errors.Wrapf(ErrParseLimitExceeded, "part larger than %d bytes", ps.limits.MaxPartSize)
+	}
+
+	ps.totalSize += int64(len(messageBody))
+	if ps.totalSize > ps.limits.MaxTotalSize {
+		return nil, errors.Wrapf(ErrParseLimitExceeded, "parts larger than %d bytes in total", ps.limits.MaxTotalSize)
+	}
+
+	return messageBody, nil
+}
+
+func ExportedEmailContainerFactory(mailboxName string, msg *imap.Message, limits ParseLimits) ([]ExportedEmailContainer, error) {
 	containers := []ExportedEmailContainer{}
+	state := &parseState{limits: limits.withDefaults()}
 	for bodySectionName, literal := range msg.Body {
-		convertedContainers, err := convertBodySectionToContainers(mailboxName, bodySectionName.BodyPartName.Specifier, literal.(io.Reader))
+		convertedContainers, err := convertBodySectionToContainers(mailboxName, bodySectionName.BodyPartName.Specifier, literal.(io.Reader), state)
 		if err != nil {
 			return nil, err
 		}
@@ -168,7 +242,7 @@ func ExportedEmailContainerFactory(mailboxName string, msg *imap.Message) ([]Exp
 	return newContainers, nil
 }
 
-func convertBodySectionToContainers(mailboxName string, partSpecifier imap.PartSpecifier, messageReader io.Reader) ([]ExportedEmailContainer, error) {
+func convertBodySectionToContainers(mailboxName string, partSpecifier imap.PartSpecifier, messageReader io.Reader, state *parseState) ([]ExportedEmailContainer, error) {
 	messageEntity, err := message.Read(messageReader)
 	if message.IsUnknownCharset(err) {
 		// This error is not fatal
@@ -177,76 +251,92 @@ func convertBodySectionToContainers(mailboxName string, partSpecifier imap.PartS
 		return nil, err
 	}
 
-	containers := []ExportedEmailContainer{}
-
 	if messageMultiPartReader := messageEntity.MultipartReader(); messageMultiPartReader != nil {
 		// This is a multipart message
-		partCount := 1
-		for {
-			p, err := messageMultiPartReader.NextPart()
-			switch {
-			case errors.Is(err, io.EOF):
-				return containers, nil
-			case err != nil && strings.Contains(err.Error(), "multipart: NextPart: EOF"):
-				return containers, nil
-			case err == nil:
-				messageEntity := *p
-				header := messageEntity.Header
-				contentType, params, err := header.ContentType()
-				if err != nil {
-					return nil, err
-				}
-				messageBody, err := io.ReadAll((*p).Body)
+		return convertMultipartToContainers(mailboxName, partSpecifier, messageMultiPartReader, 1, state)
+	}
 
+	containers := []ExportedEmailContainer{}
+	header := messageEntity.Header
+	contentType, params, err := header.ContentType()
+	if err != nil {
+		return nil, err
+	}
+	messageBody, err := state.readBody(messageEntity.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(messageBody) == 0 { // Skip empty parts
+		return nil, nil
+	}
+
+	containers = append(containers, ExportedEmailContainer{
+		msgBodyPartSpecifier: string(partSpecifier),
+		msgBodyPartPosition:  1,
+		msgBodyContentType:   contentType,
+		mailboxName:          mailboxName,
+		extractedFileName:    params["name"],
+		msgBody:              messageBody,
+	})
+
+	return containers, nil
+}
+
+// convertMultipartToContainers flattens the parts of a multipart entity, following nested
+// multiparts up to the depth limit
+func convertMultipartToContainers(mailboxName string, partSpecifier imap.PartSpecifier, messageMultiPartReader message.MultipartReader, depth int, state *parseState) ([]ExportedEmailContainer, error) {
+	if depth > state.limits.MaxDepth {
+		return nil, errors.Wrapf(ErrParseLimitExceeded, "multipart nested deeper than %d", state.limits.MaxDepth)
+	}
+
+	containers := []ExportedEmailContainer{}
+	for {
+		p, err := messageMultiPartReader.NextPart()
+		switch {
+		case errors.Is(err, io.EOF):
+			return containers, nil
+		case err != nil && strings.Contains(err.Error(), "multipart: NextPart: EOF"):
+			return containers, nil
+		case err == nil:
+			if nestedMultiPartReader := p.MultipartReader(); nestedMultiPartReader != nil {
+				nestedContainers, err := convertMultipartToContainers(mailboxName, partSpecifier, nestedMultiPartReader, depth+1, state)
 				if err != nil {
 					return nil, err
 				}
-
-				if len(messageBody) == 0 { // Skip empty parts
-					continue
+				for _, nestedContainer := range nestedContainers {
+					nestedContainer.msgBodyPartPosition = len(containers) + 1
+					containers = append(containers, nestedContainer)
 				}
+				continue
+			}
 
-				containers = append(containers, ExportedEmailContainer{
-					msgBodyPartSpecifier: string(partSpecifier),
-					msgBodyPartPosition:  partCount,
-					msgBodyContentType:   contentType,
-					mailboxName:          mailboxName,
-					extractedFileName:    params["name"],
-					msgBody:              messageBody,
-				})
-			default:
+			header := p.Header
+			contentType, params, err := header.ContentType()
+			if err != nil {
+				return nil, err
+			}
+			messageBody, err := state.readBody(p.Body)
+			if err != nil {
 				return nil, err
 			}
-			partCount++
-		}
-	} else {
-		header := messageEntity.Header
-		contentType, params, err := header.ContentType()
-		if err != nil {
-			return nil, err
-		}
-		messageBody, err := io.ReadAll(messageEntity.Body)
 
-		if err != nil {
-			return nil, err
-		}
+			if len(messageBody) == 0 { // Skip empty parts
+				continue
+			}
 
-		if len(messageBody) == 0 { // Skip empty parts
-			return nil, nil
+			containers = append(containers, ExportedEmailContainer{
+				msgBodyPartSpecifier: string(partSpecifier),
+				msgBodyPartPosition:  len(containers) + 1,
+				msgBodyContentType:   contentType,
+				mailboxName:          mailboxName,
+				extractedFileName:    params["name"],
+				msgBody:              messageBody,
+			})
+		default:
+			return nil, err
 		}
-
-		containers = append(containers, ExportedEmailContainer{
-			msgBodyPartSpecifier: string(partSpecifier),
-			msgBodyPartPosition:  1,
-			msgBodyContentType:   contentType,
-			mailboxName:          mailboxName,
-			extractedFileName:    params["name"],
-			msgBody:              messageBody,
-		})
-
 	}
-
-	return containers, nil
 }
 
 func removeEmptyStrings(s []string) []string {
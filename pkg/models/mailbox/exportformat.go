@@ -0,0 +1,161 @@
+package mailbox
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/utils"
+	"github.com/emersion/go-imap"
+	"github.com/pkg/errors"
+)
+
+// ExportFormat is how exported messages are laid out in storage
+type ExportFormat string
+
+const (
+	// ExportFormatParts writes a folder per message holding metadata.json, each body part and the
+	// attachments
+	ExportFormatParts ExportFormat = "parts"
+	// ExportFormatMbox appends the messages of a mailbox to a single mboxrd file
+	ExportFormatMbox ExportFormat = "mbox"
+	// ExportFormatMaildir writes the messages of a mailbox to a Maildir tree
+	ExportFormatMaildir ExportFormat = "maildir"
+)
+
+// mboxFromLineFormat is the asctime date which ends the From line separating mbox messages
+const mboxFromLineFormat = "Mon Jan _2 15:04:05 2006"
+
+// mboxFromRe matches the body lines an mboxrd reader would unescape, or take for a new message
+var mboxFromRe = regexp.MustCompile(`(?m)^(>*From )`)
+
+// ParseExportFormat reads an export format, empty is the parts format
+func ParseExportFormat(value string) (ExportFormat, error) {
+	switch format := ExportFormat(value); format {
+	case "":
+		return ExportFormatParts, nil
+	case ExportFormatParts, ExportFormatMbox, ExportFormatMaildir:
+		return format, nil
+	default:
+		return "", errors.Errorf("unknown export format %q, use %s, %s or %s", value, ExportFormatParts, ExportFormatMbox, ExportFormatMaildir)
+	}
+}
+
+// rawMessage reads the whole message as sent, with its line endings turned into the LF that mbox
+// and Maildir readers expect
+func rawMessage(msg *imap.Message, limits ParseLimits) ([]byte, error) {
+	literal := msg.GetBody(&imap.BodySectionName{})
+	if literal == nil {
+		return nil, errors.New("message has no body")
+	}
+
+	limits = limits.withDefaults()
+	raw, err := io.ReadAll(io.LimitReader(literal, limits.MaxTotalSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raw)) > limits.MaxTotalSize {
+		return nil, errors.Wrapf(ErrParseLimitExceeded, "message larger than %d bytes", limits.MaxTotalSize)
+	}
+
+	return bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n")), nil
+}
+
+// mboxMessage frames a raw message for an mboxrd file, a From line ahead of the body and From
+// lines within it quoted with an extra >
+func mboxMessage(msg *imap.Message, raw []byte) []byte {
+	sender := "MAILER-DAEMON"
+	if len(msg.Envelope.From) > 0 && msg.Envelope.From[0].Address() != "" {
+		sender = msg.Envelope.From[0].Address()
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", sender, msg.InternalDate.UTC().Format(mboxFromLineFormat))
+	buf.Write(mboxFromRe.ReplaceAll(raw, []byte(">$1")))
+	if !bytes.HasSuffix(raw, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	// A blank line ends each message
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// exportMboxMessage appends the message to the mailbox's mbox file, which is created by the
+// first message of an export and completed by closeMbox
+func (mb *MailboxImpl) exportMboxMessage(msg *imap.Message) (int64, error) {
+	raw, err := rawMessage(msg, mb.ParseLimits)
+	if err != nil {
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return 0, err
+	}
+
+	if mb.mbox == nil {
+		mboxFile := mboxFilePath(mb.ExportPrefix, mb.Name, time.Now())
+		if err := mb.FileManager.MkdirAll(path.Dir(mboxFile), os.ModePerm); err != nil {
+			mb.Logger.Error("Failed to create mbox folder", slog.Any("error", err))
+			return 0, err
+		}
+		writer, err := mb.FileManager.Create(mboxFile)
+		if err != nil {
+			mb.Logger.Error("Failed to create mbox file", slog.Any("error", err))
+			return 0, err
+		}
+		mb.mbox = writer
+	}
+
+	framed := mboxMessage(msg, raw)
+	if _, err := mb.mbox.Write(framed); err != nil {
+		mb.Logger.Error("Failed to write to the mbox file", slog.Any("error", utils.WrapError(err)))
+		return 0, err
+	}
+	return int64(len(framed)), nil
+}
+
+// closeMbox completes the mbox file of the export, if one was started. Messages written to it
+// aren't safe to delete until it closes without an error.
+func (mb *MailboxImpl) closeMbox() error {
+	if mb.mbox == nil {
+		return nil
+	}
+	err := mb.mbox.Close()
+	mb.mbox = nil
+	if err != nil {
+		mb.Logger.Error("Failed to write the mbox file", slog.Any("error", utils.WrapError(err)))
+	}
+	return err
+}
+
+// exportMaildirMessage writes the message to the new folder of the mailbox's Maildir. The file
+// name is made from the message's date and content, so exporting a message again replaces it.
+func (mb *MailboxImpl) exportMaildirMessage(msg *imap.Message) (int64, error) {
+	raw, err := rawMessage(msg, mb.ParseLimits)
+	if err != nil {
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return 0, err
+	}
+
+	maildirFolder := maildirFolderPath(mb.ExportPrefix, mb.Name)
+	if !mb.maildirCreated {
+		// A folder is only read as a Maildir when all three subfolders are there
+		for _, subfolder := range []string{"cur", "new", "tmp"} {
+			if err := mb.FileManager.MkdirAll(path.Join(maildirFolder, subfolder), os.ModePerm); err != nil {
+				mb.Logger.Error("Failed to create Maildir folder", slog.Any("error", err))
+				return 0, err
+			}
+		}
+		mb.maildirCreated = true
+	}
+
+	messageFile := path.Join(maildirFolder, "new", fmt.Sprintf("%d.%x.postmanpat", msg.InternalDate.Unix(), md5.Sum(raw)))
+	if err := mb.FileManager.WriteFile(messageFile, raw, os.ModePerm); err != nil {
+		mb.Logger.Error("Failed to write Maildir message", slog.Any("error", err))
+		return 0, err
+	}
+	return int64(len(raw)), nil
+}
@@ -0,0 +1,107 @@
+package mailbox
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"github.com/pkg/errors"
+)
+
+// maxPathComponentLength caps each path segment in bytes, well inside the 255 byte limit of
+// common filesystems and short enough that nested exports stay clear of the Windows MAX_PATH
+const maxPathComponentLength = 100
+
+var (
+	illegalPathCharsRe     = regexp.MustCompile(`[^\p{L}\p{N}\-_.]`)
+	windowsReservedNamesRe = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9]|lpt[0-9])(\..*)?$`)
+	prefixPlaceholderRe    = regexp.MustCompile(`\{[^{}]*\}`)
+)
+
+// Export paths are always built with forward slashes so they are the same on every OS. Each
+// FileManager converts them to its native form, a local path or an object key.
+
+// ExpandExportPrefix fills in a template for the folders exports are grouped under, inside
+// base.ExportsFolder. The template is a slash separated path which may use {account}, {run} and
+// {date}, e.g. "{account}/{date}/{run}". Each segment is sanitized, so a placeholder can't walk
+// out of the exports folder.
+func ExpandExportPrefix(template, account, runID string, date time.Time) (string, error) {
+	segments := []string{}
+	for _, segment := range strings.Split(template, "/") {
+		var unknown error
+		segment = prefixPlaceholderRe.ReplaceAllStringFunc(segment, func(placeholder string) string {
+			switch placeholder {
+			case "{account}":
+				return account
+			case "{run}":
+				return runID
+			case "{date}":
+				return date.Format("2006-01-02")
+			}
+			unknown = errors.Errorf("unknown placeholder %s in export prefix %q", placeholder, template)
+			return ""
+		})
+		if unknown != nil {
+			return "", unknown
+		}
+		if segment != "" {
+			segments = append(segments, sanitize(segment))
+		}
+	}
+	return path.Join(segments...), nil
+}
+
+// exportFolderPath is the folder a single message is exported to, prefix groups the exports of an
+// account or a run
+func exportFolderPath(prefix, mailboxName string, timestamp time.Time, subject string, hash [16]byte) string {
+	emailFolderName := fmt.Sprintf("%s-%s-%x", timestamp.UTC().Format("20060102T150405Z"), sanitize(subject), hash)
+	return path.Join(base.ExportsFolder, prefix, sanitize(mailboxName), emailFolderName)
+}
+
+// mboxFilePath is the mbox file a mailbox is exported to by the export started at timestamp
+func mboxFilePath(prefix, mailboxName string, timestamp time.Time) string {
+	mboxFileName := fmt.Sprintf("%s-%s.mbox", sanitize(mailboxName), timestamp.UTC().Format("20060102T150405Z"))
+	return path.Join(base.ExportsFolder, prefix, mboxFileName)
+}
+
+// maildirFolderPath is the Maildir a mailbox is exported to
+func maildirFolderPath(prefix, mailboxName string) string {
+	return path.Join(base.ExportsFolder, prefix, sanitize(mailboxName))
+}
+
+// sanitize turns arbitrary text into a single path segment which is valid on Linux, macOS and
+// Windows. Separators, reserved characters and whitespace become underscores, leading and
+// trailing dots are dropped, Windows device names are prefixed and long input is truncated.
+func sanitize(input string) string {
+	output := illegalPathCharsRe.ReplaceAllString(input, "_")
+	output = truncateBytes(output, maxPathComponentLength)
+
+	// Leading dots hide files or walk up the tree, trailing dots are silently dropped by Windows
+	output = strings.Trim(output, ".")
+	if output == "" {
+		return "_"
+	}
+
+	if windowsReservedNamesRe.MatchString(output) {
+		output = "_" + output
+	}
+
+	return output
+}
+
+// truncateBytes shortens a string to at most max bytes without splitting a UTF-8 sequence
+func truncateBytes(input string, max int) string {
+	if len(input) <= max {
+		return input
+	}
+
+	end := max
+	for end > 0 && !utf8.RuneStart(input[end]) {
+		end--
+	}
+	return input[:end]
+}
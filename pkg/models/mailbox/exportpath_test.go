@@ -0,0 +1,96 @@
+package mailbox
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "plain", input: "INBOX", want: "INBOX"},
+		{name: "hierarchy separators", input: `[Gmail]/Sent Mail\Old`, want: "_Gmail__Sent_Mail_Old"},
+		{name: "windows reserved characters", input: `Re: <a>|"b"?*`, want: "Re___a___b___"},
+		{name: "keeps the extension", input: "invoice 2024.pdf", want: "invoice_2024.pdf"},
+		{name: "keeps non-ascii letters", input: "Entwürfe", want: "Entwürfe"},
+		{name: "trailing dots", input: "Fwd: see below...", want: "Fwd__see_below"},
+		{name: "parent directory", input: "..", want: "_"},
+		{name: "hidden file", input: ".htaccess", want: "htaccess"},
+		{name: "empty", input: "", want: "_"},
+		{name: "device name", input: "CON", want: "_CON"},
+		{name: "device name with extension", input: "nul.txt", want: "_nul.txt"},
+		{name: "numbered device name", input: "LPT1", want: "_LPT1"},
+		{name: "device name prefix is allowed", input: "CONTACTS", want: "CONTACTS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, sanitize(tt.input))
+		})
+	}
+}
+
+func TestSanitizeTruncatesOnRuneBoundary(t *testing.T) {
+	got := sanitize(strings.Repeat("ü", maxPathComponentLength))
+
+	assert.LessOrEqual(t, len(got), maxPathComponentLength)
+	assert.Equal(t, strings.Repeat("ü", maxPathComponentLength/2), got, "a multi-byte character was split")
+}
+
+func TestExportFolderPath(t *testing.T) {
+	timestamp := time.Date(2021, 3, 15, 8, 34, 56, 0, time.FixedZone("EST", -5*60*60))
+	hash := [16]byte{0x60, 0xe4}
+
+	got := exportFolderPath("", "[Gmail]/All Mail", timestamp, "Re: Q1 report / final?", hash)
+
+	assert.Equal(t, "exportedemails/_Gmail__All_Mail/20210315T133456Z-Re__Q1_report___final_-60e40000000000000000000000000000", got)
+
+	// The path is the same on every OS, only forward slashes separate the segments
+	for _, segment := range strings.Split(got, "/") {
+		assert.False(t, strings.ContainsAny(segment, `<>:"\|?*`), "segment %q contains a character reserved on Windows", segment)
+	}
+}
+
+func TestExportFolderPathWithPrefix(t *testing.T) {
+	timestamp := time.Date(2021, 3, 15, 13, 34, 56, 0, time.UTC)
+
+	got := exportFolderPath("superman/2021-03-15", "INBOX", timestamp, "Hi", [16]byte{})
+
+	assert.Equal(t, "exportedemails/superman/2021-03-15/INBOX/20210315T133456Z-Hi-00000000000000000000000000000000", got)
+}
+
+func TestExpandExportPrefix(t *testing.T) {
+	date := time.Date(2021, 3, 15, 23, 0, 0, 0, time.FixedZone("EST", -5*60*60))
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{name: "empty", template: "", want: ""},
+		{name: "all placeholders", template: "{account}/{date}/{run}", want: "clark_kent_example.com/2021-03-15/20210316T040000Z-1a2b"},
+		{name: "placeholders inside a segment", template: "runs/{date}_{run}", want: "runs/2021-03-15_20210316T040000Z-1a2b"},
+		{name: "extra slashes", template: "/{account}//", want: "clark_kent_example.com"},
+		{name: "no walking up the tree", template: "../{account}", want: "_/clark_kent_example.com"},
+		{name: "unknown placeholder", template: "{user}/{date}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpandExportPrefix(tt.template, "clark kent@example.com", "20210316T040000Z-1a2b", date)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
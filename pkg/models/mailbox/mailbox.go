@@ -5,10 +5,9 @@ import (
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
-	"log"
 	"log/slog"
 	"os"
-	"path/filepath"
+	"path"
 	"time"
 
 	"aaronromeo.com/postmanpat/pkg/base"
@@ -16,6 +15,8 @@ import (
 	"github.com/emersion/go-imap"
 	_ "github.com/emersion/go-message/charset"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 )
 
 type Mailbox interface {
@@ -34,10 +35,60 @@ type MailboxImpl struct {
 	Logger      *slog.Logger
 	LoginFn     func() (base.Client, error)
 	LogoutFn    func() error
+
+	// Strict aborts an export on the first message that fails instead of skipping it
+	Strict bool
+	// ExportErrors collects the messages skipped during the last export
+	ExportErrors []MessageError
+	// ParseLimits bounds the parsing of each message body, unset limits use DefaultParseLimits
+	ParseLimits ParseLimits
+	// Redactor hides subjects, addresses and bodies in logs and reports
+	Redactor utils.Redactor
+	// ProtectedFlags are flags and keywords which exempt a message from export and deletion
+	ProtectedFlags []string
+	// Location is the timezone whose calendar days the lifespan is counted in, defaults to time.Local
+	Location *time.Location
+	// DryRun makes ProcessMailbox record what it would reap in Plan instead of reaping it
+	DryRun bool
+	// Plan collects the messages found by the last dry run
+	Plan []PlannedAction
+	// BatchSize caps the messages fetched by a single FETCH, defaults to DefaultBatchSize
+	BatchSize int
+	// Progress is called after each batch with the messages fetched so far and the total
+	Progress func(fetched, total int)
+	// ExportPrefix is the folder inside the exports folder that messages are exported to, see
+	// ExpandExportPrefix
+	ExportPrefix string
+	// ExportFormat is how messages are written, defaults to ExportFormatParts
+	ExportFormat ExportFormat
+	// QuarantineFolder is where messages are moved instead of being deleted, see WithQuarantine
+	QuarantineFolder string
+	// QuarantineExpiry is how long a message stays in quarantine before sweep deletes it
+	QuarantineExpiry time.Duration
+	// Quarantined collects the messages moved to the quarantine folder by the last run
+	Quarantined []QuarantinedMessage
+
+	// mbox is the file an mbox export is writing to
+	mbox utils.Writer
+	// maildirCreated is set once a Maildir export has created its folders
+	maildirCreated bool
+	// uidValidity is the UIDVALIDITY of the mailbox when it was last selected
+	uidValidity uint32
+}
+
+// MessageError records a message that was skipped because it could not be exported
+type MessageError struct {
+	MailboxName string `json:"mailboxName"`
+	SeqNum      uint32 `json:"seqNum"`
+	MessageId   string `json:"messageId"`
+	Error       string `json:"error"`
 }
 
 type MailboxOption func(*MailboxImpl) error
 
+// DefaultBatchSize keeps each FETCH small enough to finish within the fetch timeout on large mailboxes
+const DefaultBatchSize = 500
+
 type OutputFileName struct {
 	Name           string
 	Differentiator string
@@ -118,6 +169,83 @@ func WithFileManager(fileManager utils.FileManager) MailboxOption {
 	}
 }
 
+func WithStrict(strict bool) MailboxOption {
+	return func(mb *MailboxImpl) error {
+		mb.Strict = strict
+		return nil
+	}
+}
+
+func WithParseLimits(parseLimits ParseLimits) MailboxOption {
+	return func(mb *MailboxImpl) error {
+		mb.ParseLimits = parseLimits
+		return nil
+	}
+}
+
+func WithRedactor(redactor utils.Redactor) MailboxOption {
+	return func(mb *MailboxImpl) error {
+		mb.Redactor = redactor
+		return nil
+	}
+}
+
+func WithProtectedFlags(protectedFlags []string) MailboxOption {
+	return func(mb *MailboxImpl) error {
+		mb.ProtectedFlags = protectedFlags
+		return nil
+	}
+}
+
+func WithLocation(location *time.Location) MailboxOption {
+	return func(mb *MailboxImpl) error {
+		mb.Location = location
+		return nil
+	}
+}
+
+func WithDryRun(dryRun bool) MailboxOption {
+	return func(mb *MailboxImpl) error {
+		mb.DryRun = dryRun
+		return nil
+	}
+}
+
+func WithBatchSize(batchSize int) MailboxOption {
+	return func(mb *MailboxImpl) error {
+		if batchSize < 0 {
+			return errors.Errorf("batch size must not be negative, got %d", batchSize)
+		}
+		mb.BatchSize = batchSize
+		return nil
+	}
+}
+
+func WithProgress(progress func(fetched, total int)) MailboxOption {
+	return func(mb *MailboxImpl) error {
+		mb.Progress = progress
+		return nil
+	}
+}
+
+func WithExportPrefix(exportPrefix string) MailboxOption {
+	return func(mb *MailboxImpl) error {
+		mb.ExportPrefix = exportPrefix
+		return nil
+	}
+}
+
+func WithExportFormat(exportFormat ExportFormat) MailboxOption {
+	return func(mb *MailboxImpl) error {
+		format, err := ParseExportFormat(string(exportFormat))
+		if err != nil {
+			return err
+		}
+		mb.ExportFormat = format
+		return nil
+	}
+}
+
 func (mb *MailboxImpl) Reap() error {
 	return nil
 }
@@ -132,6 +260,9 @@ func (mb *MailboxImpl) wrappedLogoutFn() func() {
 
 func (mb *MailboxImpl) ProcessMailbox() error {
 	switch {
+	case mb.DryRun:
+		mb.Logger.InfoContext(mb.Ctx, "Planning mailbox", slog.String("name", mb.Name))
+		return mb.PlanMessages()
 	case mb.Exportable && mb.Deletable:
 		mb.Logger.InfoContext(mb.Ctx, "Exporting and deleting mailbox", slog.String("name", mb.Name))
 		err := mb.ExportAndDeleteMessages()
@@ -152,7 +283,7 @@ func (mb *MailboxImpl) ProcessMailbox() error {
 
 func (mb *MailboxImpl) ExportAndDeleteMessages() error {
 	// Defer logout
-	defer mb.wrappedLogoutFn()
+	defer mb.wrappedLogoutFn()()
 
 	if !mb.Exportable {
 		return fmt.Errorf("mailbox %s is not exportable", mb.Name)
@@ -170,26 +301,56 @@ func (mb *MailboxImpl) ExportAndDeleteMessages() error {
 	}
 	mb.Client = c
 
-	messages, seqSet, err := mb.fetchMessages()
+	seqSet, err := mb.searchMessages()
 	if err != nil {
 		return err
 	}
 
+	section := imap.BodySectionName{}
+	messages, done := mb.fetchMessages(seqSet, []imap.FetchItem{section.FetchItem(), imap.FetchEnvelope})
+
 	// Export messages
-	err = mb.exportMessages(messages)
+	exportStart := time.Now()
+	exportedSeqSet, err := mb.exportMessages(messages)
+	exportDurationHist.Record(mb.Ctx, time.Since(exportStart).Seconds(), metric.WithAttributes(mb.metricAttributes()...))
 	if err != nil {
+		// Let the fetch run to the end so the connection is free for the next command, in the
+		// background when cancelled so the caller isn't held up by a download it no longer wants
+		drain := func() {
+			for range messages {
+			}
+			<-done
+		}
+		if mb.ctxErr() != nil {
+			go drain()
+		} else {
+			drain()
+		}
 		return err
 	}
 
-	// Call the delete helper
-	mb.deleteMessages(c, seqSet)
+	// A fetch that broke off still leaves the messages exported so far safe to delete
+	if err := <-done; err != nil {
+		if ctxErr := mb.ctxErr(); ctxErr != nil {
+			return ctxErr
+		}
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		if deleteErr := mb.deleteMessages(c, exportedSeqSet); deleteErr != nil {
+			return deleteErr
+		}
+		return err
+	}
 
-	return nil
+	// Only delete the messages which made it into the export, and nothing once cancelled
+	if err := mb.ctxErr(); err != nil {
+		return err
+	}
+	return mb.deleteMessages(c, exportedSeqSet)
 }
 
 func (mb *MailboxImpl) DeleteMessages() error {
 	// Defer logout
-	defer mb.wrappedLogoutFn()
+	defer mb.wrappedLogoutFn()()
 
 	if !mb.Deletable {
 		return fmt.Errorf("mailbox %s is not deletable", mb.Name)
@@ -203,15 +364,17 @@ func (mb *MailboxImpl) DeleteMessages() error {
 	}
 	mb.Client = c
 
-	_, seqSet, err := mb.fetchMessages()
+	seqSet, err := mb.searchMessages()
 	if err != nil {
 		return err
 	}
 
-	// Call the delete helper
-	mb.deleteMessages(c, seqSet)
+	if err := mb.ctxErr(); err != nil {
+		return err
+	}
 
-	return nil
+	// Call the delete helper
+	return mb.deleteMessages(c, seqSet)
 }
 
 func (mb *MailboxImpl) Serialize() (base.SerializedMailbox, error) {
@@ -220,107 +383,341 @@ func (mb *MailboxImpl) Serialize() (base.SerializedMailbox, error) {
 		Exportable: mb.Exportable,
 		Deletable:  mb.Deletable,
 		Lifespan:   mb.Lifespan,
+		AgeBasis:   mb.AgeBasis,
 	}, nil
 }
 
-func (mb *MailboxImpl) deleteMessages(c base.Client, seqSet *imap.SeqSet) {
+// deleteMessages removes the messages in the set, moving them to the quarantine folder when one
+// is configured
+func (mb *MailboxImpl) deleteMessages(c base.Client, seqSet *imap.SeqSet) error {
+	if mb.QuarantineFolder != "" {
+		return mb.quarantineMessages(c, seqSet)
+	}
+	return mb.expungeMessages(c, seqSet)
+}
+
+// expungeMessages deletes the messages in the set for good
+func (mb *MailboxImpl) expungeMessages(c base.Client, seqSet *imap.SeqSet) error {
+	if seqSet.Empty() {
+		return nil
+	}
+
 	// First mark the message as deleted
 	item := imap.FormatFlagsOp(imap.AddFlags, true)
 	flags := []interface{}{imap.DeletedFlag}
 	if err := c.Store(seqSet, item, flags, nil); err != nil {
-		log.Fatal(err)
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return errors.Wrapf(err, "marking messages in %s as deleted", mb.Name)
 	}
 
 	// Then delete it
-	if err := mb.Client.Expunge(nil); err != nil {
-		log.Fatal(err)
+	if err := c.Expunge(nil); err != nil {
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return errors.Wrapf(err, "expunging %s", mb.Name)
 	}
+
+	return nil
 }
 
-func (mb *MailboxImpl) fetchMessages() (chan *imap.Message, *imap.SeqSet, error) {
-	// Select mailbox
-	mbox, err := mb.Client.Select(mb.Name, false)
+// searchMessages selects the mailbox and finds the messages which have outlived its lifespan
+func (mb *MailboxImpl) searchMessages() (*imap.SeqSet, error) {
+	// Select mailbox, a dry run only reads it so it is opened with EXAMINE
+	mbox, err := mb.Client.Select(mb.Name, mb.DryRun)
 	if err != nil {
 		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
-		return nil, nil, err
+		return nil, err
 	}
 	mb.Logger.Info(mb.Name, "Mailbox messages", mbox.Messages)
+	mb.uidValidity = mbox.UidValidity
+
+	// EXAMINE always opens the mailbox read-only, so a dry run can't tell whether deleting would be allowed
+	if mb.Deletable && mb.DryRun {
+		mb.Logger.InfoContext(mb.Ctx, "Dry run, the rights to delete from the mailbox aren't checked", slog.String("mailbox", mb.Name))
+	} else if mb.Deletable {
+		if err := checkDeletable(mbox); err != nil {
+			mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+			return nil, err
+		}
+	}
 
 	// Set search criteria
 	criteria := imap.NewSearchCriteria()
-	criteria.Before = time.Now().Add(time.Hour * 24 * time.Duration(mb.Lifespan))
+	cutoff := mb.cutoff(time.Now())
+	if mb.AgeBasis == base.AgeBasisHeader {
+		criteria.SentBefore = cutoff
+	} else {
+		criteria.Before = cutoff
+	}
+	// Protected messages are never selected, so no export or delete can reach them
+	criteria.WithoutFlags = append(criteria.WithoutFlags, mb.ProtectedFlags...)
 	ids, err := mb.Client.Search(criteria)
 	if err != nil {
-		log.Fatal(err)
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return nil, errors.Wrapf(err, "searching %s", mb.Name)
 	}
 
 	seqSet := new(imap.SeqSet)
-	if len(ids) <= 0 {
-		return nil, seqSet, nil
-	}
 	seqSet.AddNum(ids...)
+	mb.Logger.Info(mb.Name, "Matched messages count", len(ids))
 
-	section := imap.BodySectionName{}
-	messages := make(chan *imap.Message, mbox.Messages)
+	return seqSet, nil
+}
+
+// checkDeletable makes sure messages can be deleted from the selected mailbox before anything is
+// exported, so a shared or read-only mailbox fails up front instead of after a half-finished run
+func checkDeletable(mbox *imap.MailboxStatus) error {
+	if mbox.ReadOnly {
+		return errors.Errorf("mailbox %s was opened read-only, either the client is read-only or the account lacks the rights to delete from it", mbox.Name)
+	}
+
+	// Servers which don't send PERMANENTFLAGS allow every flag
+	if len(mbox.PermanentFlags) == 0 {
+		return nil
+	}
+	for _, flag := range mbox.PermanentFlags {
+		if flag == imap.DeletedFlag || flag == imap.TryCreateFlag {
+			return nil
+		}
+	}
+	return errors.Errorf("mailbox %s doesn't allow the %s flag to be set, the account lacks the rights to delete from it", mbox.Name, imap.DeletedFlag)
+}
+
+// fetchMessages streams the items of the messages in the set, one batch at a time. The channel is
+// closed once the fetch ends and its error, if any, is sent on done. An empty set returns a nil
+// channel and nothing is fetched.
+func (mb *MailboxImpl) fetchMessages(seqSet *imap.SeqSet, items []imap.FetchItem) (chan *imap.Message, <-chan error) {
 	done := make(chan error, 1)
+	if seqSet.Empty() {
+		done <- nil
+		return nil, done
+	}
+
+	batchSize := mb.BatchSize
+	if batchSize == 0 {
+		batchSize = DefaultBatchSize
+	}
+	batches, total := batchSeqSet(seqSet, batchSize)
+
+	messages := make(chan *imap.Message, 10)
 	go func() {
-		done <- mb.Client.Fetch(seqSet, []imap.FetchItem{section.FetchItem(), imap.FetchEnvelope}, messages)
+		defer close(messages)
+
+		fetched := 0
+		for _, batch := range batches {
+			// Stop between batches once cancelled rather than starting another download
+			if err := mb.ctxErr(); err != nil {
+				done <- err
+				return
+			}
+
+			batchMessages := make(chan *imap.Message, 10)
+			batchDone := make(chan error, 1)
+			go func() {
+				batchDone <- mb.Client.Fetch(batch.seqSet, items, batchMessages)
+			}()
+			for msg := range batchMessages {
+				messages <- msg
+			}
+			if err := <-batchDone; err != nil {
+				done <- err
+				return
+			}
+
+			fetched += batch.count
+			if mb.Progress != nil {
+				mb.Progress(fetched, total)
+			}
+		}
+		done <- nil
 	}()
 
-	mb.Logger.Info(mb.Name, "Fetched messages count", len(messages))
+	return messages, done
+}
 
-	return messages, seqSet, nil
+type seqSetBatch struct {
+	seqSet *imap.SeqSet
+	count  int
 }
 
-func (mb *MailboxImpl) exportMessages(messages chan *imap.Message) error {
-	for msg := range messages {
-		metadata := CreateExportedEmailMetadata(msg, mb.Name)
-		metadataBytes, err := json.MarshalIndent(metadata, "", "  ")
-		if err != nil {
-			mb.Logger.Error("Failed to serialize metadata", slog.Any("error", err))
-			return err
+// batchSeqSet splits a set of sequence numbers into sets of at most batchSize messages. A set that
+// fits in one batch is used as is.
+func batchSeqSet(seqSet *imap.SeqSet, batchSize int) ([]seqSetBatch, int) {
+	var nums []uint32
+	for _, seq := range seqSet.Set {
+		for num := seq.Start; num <= seq.Stop; num++ {
+			nums = append(nums, num)
 		}
-		baseFolder := filepath.Join(".", "exportedemails")
-		basePath := filepath.Join(baseFolder, sanitize(mb.Name))
+	}
+	if len(nums) <= batchSize {
+		return []seqSetBatch{{seqSet: seqSet, count: len(nums)}}, len(nums)
+	}
 
-		// Unique folder for each email
-		msgHash, err := json.Marshal(metadata)
-		if err != nil {
-			mb.Logger.Error("Unable to hash message", slog.Any("error", err))
-			return err
+	var batches []seqSetBatch
+	for start := 0; start < len(nums); start += batchSize {
+		end := min(start+batchSize, len(nums))
+		batch := new(imap.SeqSet)
+		batch.AddNum(nums[start:end]...)
+		batches = append(batches, seqSetBatch{seqSet: batch, count: end - start})
+	}
+	return batches, len(nums)
+}
+
+func (mb *MailboxImpl) exportMessages(messages chan *imap.Message) (exported *imap.SeqSet, err error) {
+	mb.ExportErrors = nil
+	mb.maildirCreated = false
+	exportedSeqSet := new(imap.SeqSet)
+	if messages == nil {
+		return exportedSeqSet, nil
+	}
+
+	// None of the messages in an mbox file are exported unless the whole file is written
+	defer func() {
+		if closeErr := mb.closeMbox(); closeErr != nil && err == nil {
+			exported, err = nil, closeErr
 		}
-		emailFolderName := fmt.Sprintf("%s-%s-%x", metadata.Timestamp.Format("20060102T150405Z"), sanitize(metadata.Subject), md5.Sum([]byte(msgHash)))
-		emailFolderPath := filepath.Join(basePath, emailFolderName)
-		err = mb.FileManager.MkdirAll(emailFolderPath, os.ModePerm)
-		if err != nil {
-			mb.Logger.Error("Failed to create email folder", slog.Any("error", err))
-			return err
+	}()
+
+	for {
+		var msg *imap.Message
+		var ok bool
+		select {
+		case <-mb.ctxDone():
+			return nil, mb.Ctx.Err()
+		case msg, ok = <-messages:
+		}
+		if !ok {
+			break
 		}
 
-		metadataFile := filepath.Join(emailFolderPath, "metadata.json")
+		if err := mb.exportMessage(msg); err != nil {
+			if mb.Strict {
+				return nil, err
+			}
 
-		err = mb.FileManager.WriteFile(metadataFile, metadataBytes, os.ModePerm)
-		if err != nil {
-			mb.Logger.Error("Failed to write metadata file", slog.Any("error", err))
-			return err
+			messageError := MessageError{
+				MailboxName: mb.Name,
+				SeqNum:      msg.SeqNum,
+				Error:       err.Error(),
+			}
+			if msg.Envelope != nil {
+				messageError.MessageId = mb.Redactor.Redact(msg.Envelope.MessageId)
+			}
+			mb.ExportErrors = append(mb.ExportErrors, messageError)
+			mb.Logger.WarnContext(mb.Ctx, "Skipping message which failed to export", slog.Any("seqNum", msg.SeqNum), slog.Any("error", utils.WrapError(err)))
+			continue
 		}
+		exportedSeqSet.AddNum(msg.SeqNum)
+	}
+	return exportedSeqSet, nil
+}
+
+func (mb *MailboxImpl) exportMessage(msg *imap.Message) error {
+	if msg.Envelope == nil {
+		return errors.New("message has no envelope")
+	}
+
+	var exportedBytes int64
+	var err error
+	switch mb.ExportFormat {
+	case ExportFormatMbox:
+		exportedBytes, err = mb.exportMboxMessage(msg)
+	case ExportFormatMaildir:
+		exportedBytes, err = mb.exportMaildirMessage(msg)
+	default:
+		exportedBytes, err = mb.exportMessageParts(msg)
+	}
+	if err != nil {
+		return err
+	}
+
+	exportedMessagesCnt.Add(mb.Ctx, 1, metric.WithAttributes(mb.metricAttributes()...))
+	exportedBytesCnt.Add(mb.Ctx, exportedBytes, metric.WithAttributes(mb.metricAttributes()...))
+	mb.Logger.Info(mb.Name, "Exported message", mb.Redactor.Redact(msg.Envelope.Subject))
+	return nil
+}
+
+// exportMessageParts writes the message's metadata, body parts and attachments to a folder of
+// its own, returning the bytes written
+func (mb *MailboxImpl) exportMessageParts(msg *imap.Message) (int64, error) {
+	metadata := CreateExportedEmailMetadata(msg, mb.Name)
+	metadataBytes, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		mb.Logger.Error("Failed to serialize metadata", slog.Any("error", err))
+		return 0, err
+	}
+	// Unique folder for each email
+	msgHash, err := json.Marshal(metadata)
+	if err != nil {
+		mb.Logger.Error("Unable to hash message", slog.Any("error", err))
+		return 0, err
+	}
+	emailFolderPath := exportFolderPath(mb.ExportPrefix, mb.Name, metadata.Timestamp, metadata.Subject, md5.Sum(msgHash))
+
+	// Parse the body before writing anything so a malformed message leaves no partial export behind
+	mb.Logger.Info(mb.Name, "Subject", mb.Redactor.Redact(msg.Envelope.Subject))
+	messageContainers, err := ExportedEmailContainerFactory(mb.Name, msg, mb.ParseLimits)
+	if err != nil {
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return 0, err
+	}
+
+	// The folder is named after the subject, so storage errors holding it are redacted
+	err = mb.FileManager.MkdirAll(emailFolderPath, os.ModePerm)
+	if err != nil {
+		err = mb.Redactor.RedactError(err, emailFolderPath)
+		mb.Logger.Error("Failed to create email folder", slog.Any("error", err))
+		return 0, err
+	}
+
+	metadataFile := path.Join(emailFolderPath, "metadata.json")
+
+	err = mb.FileManager.WriteFile(metadataFile, metadataBytes, os.ModePerm)
+	if err != nil {
+		err = mb.Redactor.RedactError(err, emailFolderPath)
+		mb.Logger.Error("Failed to write metadata file", slog.Any("error", err))
+		return 0, err
+	}
+	exportedBytes := int64(len(metadataBytes))
 
-		mb.Logger.Info(mb.Name, "Subject", msg.Envelope.Subject)
-		messageContainers, err := ExportedEmailContainerFactory(mb.Name, msg)
+	for _, emb := range messageContainers {
+		err := emb.WriteToFile(mb.Logger, mb.Redactor, mb.FileManager, emailFolderPath)
 		if err != nil {
 			mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
-			return err
+			return 0, err
 		}
+		exportedBytes += emb.writtenSize()
+	}
 
-		for _, emb := range messageContainers {
-			err := emb.WriteToFile(mb.Logger, mb.FileManager, emailFolderPath)
-			if err != nil {
-				mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
-				return err
-			}
-		}
+	return exportedBytes, nil
+}
 
-		mb.Logger.Info(mb.Name, "Exported message", msg.Envelope.Subject)
+// ctxDone is closed when the mailbox's context is cancelled, a mailbox without a context never is
+func (mb *MailboxImpl) ctxDone() <-chan struct{} {
+	if mb.Ctx == nil {
+		return nil
 	}
-	return nil
+	return mb.Ctx.Done()
+}
+
+func (mb *MailboxImpl) ctxErr() error {
+	if mb.Ctx == nil {
+		return nil
+	}
+	return mb.Ctx.Err()
+}
+
+// cutoff is the start of the local day Lifespan days ago. IMAP compares dates without times, so
+// anything dated before that day has outlived the lifespan
+func (mb *MailboxImpl) cutoff(now time.Time) time.Time {
+	location := mb.Location
+	if location == nil {
+		location = time.Local
+	}
+
+	now = now.In(location)
+	return time.Date(now.Year(), now.Month(), now.Day()-mb.Lifespan, 0, 0, 0, 0, location)
+}
+
+func (mb *MailboxImpl) metricAttributes() []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("mailbox.name", mb.Name)}
 }
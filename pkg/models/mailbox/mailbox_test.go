@@ -2,6 +2,9 @@ package mailbox_test
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path"
 	"strings"
 	"testing"
 	"time"
@@ -13,8 +16,8 @@ import (
 	"aaronromeo.com/postmanpat/pkg/base"
 	"aaronromeo.com/postmanpat/pkg/mock"
 	"aaronromeo.com/postmanpat/pkg/models/mailbox"
+	"github.com/stretchr/testify/assert"
 	// "github.com/emersion/go-imap"
-	// "github.com/stretchr/testify/assert"
 	// "go.uber.org/mock/gomock"
 )
 
@@ -362,7 +365,8 @@ func TestProcessMailbox(t *testing.T) {
 				mockClient.EXPECT().Fetch(seqSet, gomock.Any(), gomock.Any()).DoAndReturn(fetchRet)
 
 				criteria := imap.NewSearchCriteria()
-				criteria.Before = time.Now().Add(time.Hour * 24 * time.Duration(mb.Lifespan))
+				now := time.Now()
+				criteria.Before = time.Date(now.Year(), now.Month(), now.Day()-mb.Lifespan, 0, 0, 0, 0, time.Local)
 				tolerance := time.Second
 				mockClient.EXPECT().Search(mock.NewSearchCriteriaMatcher(criteria, tolerance)).Return(expectedSeq, nil)
 			}
@@ -402,3 +406,876 @@ func TestProcessMailbox(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessMailboxSkipsFailedMessages(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	messages := []*imap.Message{
+		{
+			SeqNum:       1,
+			InternalDate: time.Date(2022, 5, 10, 6, 12, 45, 0, time.UTC),
+			Envelope: &imap.Envelope{
+				Subject:   "Plain Text Email",
+				MessageId: "28F7274B-F6B1-45EA-AD31-69EDCB5DE32C",
+			},
+			Body: map[*imap.BodySectionName]imap.Literal{
+				{}: mock.NewStringLiteral("Subject: Plain Text Email\r\n\r\nHello, this is a plain text email.\r\n"),
+			},
+		},
+		{
+			// A message without an envelope cannot be exported
+			SeqNum:       2,
+			InternalDate: time.Date(2022, 5, 10, 6, 12, 45, 0, time.UTC),
+		},
+	}
+
+	tests := []struct {
+		name           string
+		strict         bool
+		wantErr        bool
+		wantErrorCount int
+	}{
+		{name: "Skip the failed message", strict: false, wantErr: false, wantErrorCount: 1},
+		{name: "Strict aborts on the failed message", strict: true, wantErr: true, wantErrorCount: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockClient := mock.NewMockClient(ctrl)
+			mb := &mailbox.MailboxImpl{
+				SerializedMailbox: base.SerializedMailbox{
+					Name:       "INBOX",
+					Lifespan:   30,
+					Exportable: true,
+					Deletable:  true,
+				},
+				LoginFn:     func() (base.Client, error) { return mockClient, nil },
+				LogoutFn:    func() error { return nil },
+				Client:      mockClient,
+				Logger:      mock.SetupLogger(t),
+				Ctx:         context.Background(),
+				FileManager: mock.MockFileWriter{Writers: map[string]mock.MockWriter{}},
+				Strict:      tc.strict,
+			}
+
+			mockClient.EXPECT().Select("INBOX", false).Return(&imap.MailboxStatus{Messages: uint32(len(messages))}, nil)
+			mockClient.EXPECT().Search(gomock.Any()).Return([]uint32{1, 2}, nil)
+			mockClient.EXPECT().Fetch(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+				func(seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+					defer close(ch)
+					for _, msg := range messages {
+						ch <- msg
+					}
+					return nil
+				},
+			)
+
+			if !tc.strict {
+				// Only the exported message is deleted
+				exportedSeqSet := new(imap.SeqSet)
+				exportedSeqSet.AddNum(1)
+				mockClient.EXPECT().Store(exportedSeqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil).Return(nil)
+				mockClient.EXPECT().Expunge(nil).Return(nil)
+			}
+
+			err := mb.ProcessMailbox()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ProcessMailbox() error = %v, wantErr %v", err, tc.wantErr)
+			}
+
+			if len(mb.ExportErrors) != tc.wantErrorCount {
+				t.Fatalf("Incorrect export error count. want: %d got: %d", tc.wantErrorCount, len(mb.ExportErrors))
+			}
+			if tc.wantErrorCount > 0 && mb.ExportErrors[0].SeqNum != 2 {
+				t.Fatalf("Incorrect skipped message. want: 2 got: %d", mb.ExportErrors[0].SeqNum)
+			}
+		})
+	}
+}
+
+func TestExportedEmailContainerFactoryParseLimits(t *testing.T) {
+	nested := "Subject: Nested\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello, this is text part.\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>Hello, this is HTML part.</p>\r\n" +
+		"--inner--\r\n" +
+		"--outer--\r\n"
+
+	tests := []struct {
+		name           string
+		limits         mailbox.ParseLimits
+		wantErr        bool
+		wantContainers int
+	}{
+		{name: "Default limits", limits: mailbox.ParseLimits{}, wantErr: false, wantContainers: 2},
+		{name: "Nesting too deep", limits: mailbox.ParseLimits{MaxDepth: 1}, wantErr: true},
+		{name: "Too many parts", limits: mailbox.ParseLimits{MaxParts: 1}, wantErr: true},
+		{name: "Part too large", limits: mailbox.ParseLimits{MaxPartSize: 10}, wantErr: true},
+		{name: "Message too large", limits: mailbox.ParseLimits{MaxTotalSize: 40}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := &imap.Message{
+				Body: map[*imap.BodySectionName]imap.Literal{
+					{}: mock.NewStringLiteral(nested),
+				},
+			}
+
+			containers, err := mailbox.ExportedEmailContainerFactory("INBOX", msg, tc.limits)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ExportedEmailContainerFactory() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr && !errors.Is(err, mailbox.ErrParseLimitExceeded) {
+				t.Fatalf("Expected a parse limit error, got %v", err)
+			}
+			if len(containers) != tc.wantContainers {
+				t.Fatalf("Incorrect container count. want: %d got: %d", tc.wantContainers, len(containers))
+			}
+		})
+	}
+}
+
+func TestDeleteMessagesExcludesProtectedFlags(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	protectedFlags := []string{imap.FlaggedFlag, "$NotJunk"}
+	mb := &mailbox.MailboxImpl{
+		SerializedMailbox: base.SerializedMailbox{
+			Name:      "INBOX",
+			Lifespan:  30,
+			Deletable: true,
+		},
+		LoginFn:        func() (base.Client, error) { return mockClient, nil },
+		LogoutFn:       func() error { return nil },
+		Client:         mockClient,
+		Logger:         mock.SetupLogger(t),
+		Ctx:            context.Background(),
+		FileManager:    mock.MockFileWriter{Writers: map[string]mock.MockWriter{}},
+		ProtectedFlags: protectedFlags,
+	}
+
+	mockClient.EXPECT().Select("INBOX", false).Return(&imap.MailboxStatus{Messages: 3}, nil)
+	mockClient.EXPECT().Search(gomock.Any()).DoAndReturn(func(criteria *imap.SearchCriteria) ([]uint32, error) {
+		if len(criteria.WithoutFlags) != len(protectedFlags) {
+			t.Fatalf("Incorrect excluded flags. want: %v got: %v", protectedFlags, criteria.WithoutFlags)
+		}
+		for i, flag := range protectedFlags {
+			if criteria.WithoutFlags[i] != flag {
+				t.Fatalf("Incorrect excluded flags. want: %v got: %v", protectedFlags, criteria.WithoutFlags)
+			}
+		}
+		// The server leaves out the protected message 2
+		return []uint32{1, 3}, nil
+	})
+	deletedSeqSet := new(imap.SeqSet)
+	deletedSeqSet.AddNum(1, 3)
+	mockClient.EXPECT().Store(deletedSeqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil).Return(nil)
+	mockClient.EXPECT().Expunge(nil).Return(nil)
+
+	if err := mb.DeleteMessages(); err != nil {
+		t.Fatalf("DeleteMessages() error = %v", err)
+	}
+}
+
+func TestProcessMailboxChecksDeleteRights(t *testing.T) {
+	tests := []struct {
+		name       string
+		mboxStatus *imap.MailboxStatus
+		wantErr    bool
+	}{
+		{
+			name:       "Opened read-only",
+			mboxStatus: &imap.MailboxStatus{Name: "INBOX", ReadOnly: true},
+			wantErr:    true,
+		},
+		{
+			name:       "Deleted flag not permanent",
+			mboxStatus: &imap.MailboxStatus{Name: "INBOX", PermanentFlags: []string{imap.SeenFlag}},
+			wantErr:    true,
+		},
+		{
+			name:       "Deleted flag permanent",
+			mboxStatus: &imap.MailboxStatus{Name: "INBOX", PermanentFlags: []string{imap.SeenFlag, imap.DeletedFlag}},
+		},
+		{
+			name:       "Any flag permanent",
+			mboxStatus: &imap.MailboxStatus{Name: "INBOX", PermanentFlags: []string{imap.TryCreateFlag}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockClient := mock.NewMockClient(ctrl)
+			mb := &mailbox.MailboxImpl{
+				SerializedMailbox: base.SerializedMailbox{
+					Name:       "INBOX",
+					Lifespan:   30,
+					Exportable: true,
+					Deletable:  true,
+				},
+				LoginFn:     func() (base.Client, error) { return mockClient, nil },
+				LogoutFn:    func() error { return nil },
+				Client:      mockClient,
+				Logger:      mock.SetupLogger(t),
+				Ctx:         context.Background(),
+				FileManager: mock.MockFileWriter{Writers: map[string]mock.MockWriter{}},
+			}
+
+			mockClient.EXPECT().Select("INBOX", false).Return(tt.mboxStatus, nil)
+			if !tt.wantErr {
+				mockClient.EXPECT().Search(gomock.Any()).Return([]uint32{}, nil)
+			}
+
+			// Nothing is fetched or stored when the rights are missing
+			err := mb.ProcessMailbox()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProcessMailbox() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProcessMailboxDryRun(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	now := time.Now()
+	mb := &mailbox.MailboxImpl{
+		SerializedMailbox: base.SerializedMailbox{
+			Name:       "INBOX",
+			Lifespan:   30,
+			Exportable: true,
+			Deletable:  true,
+		},
+		LoginFn:     func() (base.Client, error) { return mockClient, nil },
+		LogoutFn:    func() error { return nil },
+		Client:      mockClient,
+		Logger:      mock.SetupLogger(t),
+		Ctx:         context.Background(),
+		FileManager: mock.MockFileWriter{Writers: map[string]mock.MockWriter{}},
+		DryRun:      true,
+	}
+
+	// The dry run opens the mailbox with EXAMINE, which is read-only and doesn't stop the plan
+	mockClient.EXPECT().Select("INBOX", true).Return(&imap.MailboxStatus{Messages: 2, UidValidity: 1714000000, ReadOnly: true}, nil)
+	mockClient.EXPECT().Search(gomock.Any()).Return([]uint32{1, 2}, nil)
+	// Only the envelopes are fetched, and nothing is stored or expunged
+	mockClient.EXPECT().Fetch(gomock.Any(), []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchInternalDate}, gomock.Any()).DoAndReturn(
+		func(_ *imap.SeqSet, _ []imap.FetchItem, ch chan *imap.Message) error {
+			ch <- &imap.Message{SeqNum: 2, Uid: 107, InternalDate: now, Envelope: &imap.Envelope{Subject: "Second", MessageId: "2@example.com", Date: now}}
+			ch <- &imap.Message{SeqNum: 1, Uid: 42, InternalDate: now, Envelope: &imap.Envelope{Subject: "First", MessageId: "1@example.com", Date: now}}
+			close(ch)
+			return nil
+		},
+	)
+
+	if err := mb.ProcessMailbox(); err != nil {
+		t.Fatalf("ProcessMailbox() error = %v", err)
+	}
+
+	if len(mb.Plan) != 2 {
+		t.Fatalf("Incorrect plan length. want: 2 got: %d", len(mb.Plan))
+	}
+	for i, want := range []struct {
+		uid     uint32
+		subject string
+	}{{42, "First"}, {107, "Second"}} {
+		planned := mb.Plan[i]
+		if planned.UID != want.uid || planned.Subject != want.subject {
+			t.Errorf("Incorrect planned action %d. want: %d %s got: %d %s", i, want.uid, want.subject, planned.UID, planned.Subject)
+		}
+		if planned.MailboxName != "INBOX" || planned.UIDValidity != 1714000000 || planned.Action != mailbox.PlanActionExportAndDelete {
+			t.Errorf("Incorrect planned action %d: %+v", i, planned)
+		}
+		if !strings.Contains(planned.Reason, "lifespan of 30 days") {
+			t.Errorf("Incorrect reason: %s", planned.Reason)
+		}
+	}
+}
+
+func TestProcessMailboxFetchesInBatches(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	var progress [][2]int
+	mb := &mailbox.MailboxImpl{
+		SerializedMailbox: base.SerializedMailbox{
+			Name:      "INBOX",
+			Lifespan:  30,
+			Deletable: true,
+		},
+		LoginFn:     func() (base.Client, error) { return mockClient, nil },
+		LogoutFn:    func() error { return nil },
+		Client:      mockClient,
+		Logger:      mock.SetupLogger(t),
+		Ctx:         context.Background(),
+		FileManager: mock.MockFileWriter{Writers: map[string]mock.MockWriter{}},
+		DryRun:      true,
+		BatchSize:   2,
+		Progress:    func(fetched, total int) { progress = append(progress, [2]int{fetched, total}) },
+	}
+
+	mockClient.EXPECT().Select("INBOX", true).Return(&imap.MailboxStatus{Messages: 9}, nil)
+	mockClient.EXPECT().Search(gomock.Any()).Return([]uint32{2, 3, 7}, nil)
+	firstBatch := new(imap.SeqSet)
+	firstBatch.AddNum(2, 3)
+	secondBatch := new(imap.SeqSet)
+	secondBatch.AddNum(7)
+	for _, batch := range []*imap.SeqSet{firstBatch, secondBatch} {
+		mockClient.EXPECT().Fetch(batch, gomock.Any(), gomock.Any()).DoAndReturn(
+			func(seqSet *imap.SeqSet, _ []imap.FetchItem, ch chan *imap.Message) error {
+				for _, seq := range seqSet.Set {
+					for num := seq.Start; num <= seq.Stop; num++ {
+						ch <- &imap.Message{SeqNum: num, Uid: num * 10, Envelope: &imap.Envelope{}}
+					}
+				}
+				close(ch)
+				return nil
+			},
+		)
+	}
+
+	if err := mb.ProcessMailbox(); err != nil {
+		t.Fatalf("ProcessMailbox() error = %v", err)
+	}
+
+	if len(mb.Plan) != 3 {
+		t.Fatalf("Incorrect plan length. want: 3 got: %d", len(mb.Plan))
+	}
+	wantProgress := [][2]int{{2, 3}, {3, 3}}
+	if len(progress) != len(wantProgress) || progress[0] != wantProgress[0] || progress[1] != wantProgress[1] {
+		t.Fatalf("Incorrect progress. want: %v got: %v", wantProgress, progress)
+	}
+}
+
+func TestDeleteMessagesAgeBasis(t *testing.T) {
+	tests := []struct {
+		name           string
+		ageBasis       base.AgeBasis
+		wantSentBefore bool
+	}{
+		{name: "Default uses the internal date", ageBasis: "", wantSentBefore: false},
+		{name: "Internal date", ageBasis: base.AgeBasisInternal, wantSentBefore: false},
+		{name: "Header date", ageBasis: base.AgeBasisHeader, wantSentBefore: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockClient := mock.NewMockClient(ctrl)
+			mb := &mailbox.MailboxImpl{
+				SerializedMailbox: base.SerializedMailbox{
+					Name:      "INBOX",
+					Lifespan:  30,
+					Deletable: true,
+					AgeBasis:  tc.ageBasis,
+				},
+				LoginFn:     func() (base.Client, error) { return mockClient, nil },
+				LogoutFn:    func() error { return nil },
+				Client:      mockClient,
+				Logger:      mock.SetupLogger(t),
+				Ctx:         context.Background(),
+				FileManager: mock.MockFileWriter{Writers: map[string]mock.MockWriter{}},
+			}
+
+			mockClient.EXPECT().Select("INBOX", false).Return(&imap.MailboxStatus{}, nil)
+			mockClient.EXPECT().Search(gomock.Any()).DoAndReturn(func(criteria *imap.SearchCriteria) ([]uint32, error) {
+				if criteria.SentBefore.IsZero() == tc.wantSentBefore {
+					t.Fatalf("Incorrect SentBefore. want set: %v got: %v", tc.wantSentBefore, criteria.SentBefore)
+				}
+				if criteria.Before.IsZero() != tc.wantSentBefore {
+					t.Fatalf("Incorrect Before. want set: %v got: %v", !tc.wantSentBefore, criteria.Before)
+				}
+				return []uint32{}, nil
+			})
+
+			if err := mb.DeleteMessages(); err != nil {
+				t.Fatalf("DeleteMessages() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestDeleteMessagesCutoff(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Far enough from UTC that the local day differs from the UTC day for half of every day
+	location := time.FixedZone("UTC+13", 13*60*60)
+
+	mockClient := mock.NewMockClient(ctrl)
+	mb := &mailbox.MailboxImpl{
+		SerializedMailbox: base.SerializedMailbox{
+			Name:      "INBOX",
+			Lifespan:  30,
+			Deletable: true,
+		},
+		LoginFn:     func() (base.Client, error) { return mockClient, nil },
+		LogoutFn:    func() error { return nil },
+		Client:      mockClient,
+		Logger:      mock.SetupLogger(t),
+		Ctx:         context.Background(),
+		FileManager: mock.MockFileWriter{Writers: map[string]mock.MockWriter{}},
+		Location:    location,
+	}
+
+	mockClient.EXPECT().Select("INBOX", false).Return(&imap.MailboxStatus{}, nil)
+	mockClient.EXPECT().Search(gomock.Any()).DoAndReturn(func(criteria *imap.SearchCriteria) ([]uint32, error) {
+		now := time.Now().In(location)
+		want := time.Date(now.Year(), now.Month(), now.Day()-30, 0, 0, 0, 0, location)
+		if !criteria.Before.Equal(want) || criteria.Before.Location() != location {
+			t.Fatalf("Incorrect cutoff. want: %v got: %v", want, criteria.Before)
+		}
+		return []uint32{}, nil
+	})
+
+	if err := mb.DeleteMessages(); err != nil {
+		t.Fatalf("DeleteMessages() error = %v", err)
+	}
+}
+
+func TestProcessMailboxReturnsErrors(t *testing.T) {
+	exportedMessage := &imap.Message{
+		SeqNum:       1,
+		InternalDate: time.Date(2022, 5, 10, 6, 12, 45, 0, time.UTC),
+		Envelope: &imap.Envelope{
+			Subject:   "Plain Text Email",
+			MessageId: "28F7274B-F6B1-45EA-AD31-69EDCB5DE32C",
+		},
+		Body: map[*imap.BodySectionName]imap.Literal{
+			{}: mock.NewStringLiteral("Subject: Plain Text Email\r\n\r\nHello, this is a plain text email.\r\n"),
+		},
+	}
+	exportedSeqSet := new(imap.SeqSet)
+	exportedSeqSet.AddNum(1)
+	deleteItem := imap.FormatFlagsOp(imap.AddFlags, true)
+	deleteFlags := []interface{}{imap.DeletedFlag}
+
+	tests := []struct {
+		name       string
+		exportable bool
+		expect     func(mockClient *mock.MockClient)
+	}{
+		{
+			name: "Search fails",
+			expect: func(mockClient *mock.MockClient) {
+				mockClient.EXPECT().Search(gomock.Any()).Return(nil, errors.New("search failed"))
+			},
+		},
+		{
+			name: "Store fails",
+			expect: func(mockClient *mock.MockClient) {
+				mockClient.EXPECT().Search(gomock.Any()).Return([]uint32{1}, nil)
+				mockClient.EXPECT().Store(exportedSeqSet, deleteItem, deleteFlags, nil).Return(errors.New("store failed"))
+			},
+		},
+		{
+			name: "Expunge fails",
+			expect: func(mockClient *mock.MockClient) {
+				mockClient.EXPECT().Search(gomock.Any()).Return([]uint32{1}, nil)
+				mockClient.EXPECT().Store(exportedSeqSet, deleteItem, deleteFlags, nil).Return(nil)
+				mockClient.EXPECT().Expunge(nil).Return(errors.New("expunge failed"))
+			},
+		},
+		{
+			name:       "Fetch breaks off after the first message",
+			exportable: true,
+			expect: func(mockClient *mock.MockClient) {
+				mockClient.EXPECT().Search(gomock.Any()).Return([]uint32{1, 2}, nil)
+				mockClient.EXPECT().Fetch(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+					func(seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+						defer close(ch)
+						ch <- exportedMessage
+						return errors.New("connection reset")
+					},
+				)
+				// The message exported before the fetch broke off is still deleted
+				mockClient.EXPECT().Store(exportedSeqSet, deleteItem, deleteFlags, nil).Return(nil)
+				mockClient.EXPECT().Expunge(nil).Return(nil)
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockClient := mock.NewMockClient(ctrl)
+			mb := &mailbox.MailboxImpl{
+				SerializedMailbox: base.SerializedMailbox{
+					Name:       "INBOX",
+					Lifespan:   30,
+					Exportable: tc.exportable,
+					Deletable:  true,
+				},
+				LoginFn:     func() (base.Client, error) { return mockClient, nil },
+				LogoutFn:    func() error { return nil },
+				Client:      mockClient,
+				Logger:      mock.SetupLogger(t),
+				Ctx:         context.Background(),
+				FileManager: mock.MockFileWriter{Writers: map[string]mock.MockWriter{}},
+			}
+
+			mockClient.EXPECT().Select("INBOX", false).Return(&imap.MailboxStatus{Messages: 2}, nil)
+			tc.expect(mockClient)
+
+			if err := mb.ProcessMailbox(); err == nil {
+				t.Fatalf("ProcessMailbox() returned no error")
+			}
+		})
+	}
+}
+
+func TestProcessMailboxStopsWhenCancelled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockClient := mock.NewMockClient(ctrl)
+	mb := &mailbox.MailboxImpl{
+		SerializedMailbox: base.SerializedMailbox{
+			Name:       "INBOX",
+			Lifespan:   30,
+			Exportable: true,
+			Deletable:  true,
+		},
+		LoginFn:     func() (base.Client, error) { return mockClient, nil },
+		LogoutFn:    func() error { return nil },
+		Client:      mockClient,
+		Logger:      mock.SetupLogger(t),
+		Ctx:         ctx,
+		FileManager: mock.MockFileWriter{Writers: map[string]mock.MockWriter{}},
+	}
+
+	fetchDone := make(chan struct{})
+	mockClient.EXPECT().Select("INBOX", false).Return(&imap.MailboxStatus{Messages: 2}, nil)
+	mockClient.EXPECT().Search(gomock.Any()).Return([]uint32{1, 2}, nil)
+	mockClient.EXPECT().Fetch(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+			defer close(fetchDone)
+			defer close(ch)
+			// The user hits Ctrl-C while the first message is still downloading
+			cancel()
+			ch <- &imap.Message{
+				SeqNum:       1,
+				InternalDate: time.Date(2022, 5, 10, 6, 12, 45, 0, time.UTC),
+				Envelope:     &imap.Envelope{Subject: "Plain Text Email"},
+				Body: map[*imap.BodySectionName]imap.Literal{
+					{}: mock.NewStringLiteral("Subject: Plain Text Email\r\n\r\nHello.\r\n"),
+				},
+			}
+			return nil
+		},
+	)
+	// Neither Store nor Expunge may be sent once cancelled
+
+	err := mb.ProcessMailbox()
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ProcessMailbox() error = %v, want %v", err, context.Canceled)
+	}
+	<-fetchDone
+}
+
+func TestProcessMailboxExportFormats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	newMessages := func() []*imap.Message {
+		return []*imap.Message{
+			{
+				SeqNum:       1,
+				InternalDate: time.Date(2022, 5, 10, 6, 12, 45, 0, time.UTC),
+				Envelope: &imap.Envelope{
+					Subject:   "Plain Text Email",
+					From:      []*imap.Address{{MailboxName: "sender", HostName: "example.com"}},
+					MessageId: "28F7274B-F6B1-45EA-AD31-69EDCB5DE32C",
+				},
+				Body: map[*imap.BodySectionName]imap.Literal{
+					{}: mock.NewStringLiteral("Subject: Plain Text Email\r\n\r\nHello,\r\nFrom the sender\r\n"),
+				},
+			},
+			{
+				SeqNum:       2,
+				InternalDate: time.Date(2022, 5, 11, 7, 0, 0, 0, time.UTC),
+				Envelope: &imap.Envelope{
+					Subject:   "No Sender",
+					MessageId: "5AA34A5D-7E77-43FF-A95F-3DE3A1CB4AC4",
+				},
+				Body: map[*imap.BodySectionName]imap.Literal{
+					{}: mock.NewStringLiteral("Subject: No Sender\r\n\r\nBye"),
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		format    mailbox.ExportFormat
+		wantFiles map[string]string
+	}{
+		{
+			format: mailbox.ExportFormatMbox,
+			wantFiles: map[string]string{
+				"INBOX-*.mbox": "From sender@example.com Tue May 10 06:12:45 2022\n" +
+					"Subject: Plain Text Email\n\nHello,\n>From the sender\n\n" +
+					"From MAILER-DAEMON Wed May 11 07:00:00 2022\n" +
+					"Subject: No Sender\n\nBye\n\n",
+			},
+		},
+		{
+			format: mailbox.ExportFormatMaildir,
+			wantFiles: map[string]string{
+				"INBOX/new/1652163165.*.postmanpat": "Subject: Plain Text Email\n\nHello,\nFrom the sender\n",
+				"INBOX/new/1652252400.*.postmanpat": "Subject: No Sender\n\nBye",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(string(tc.format), func(t *testing.T) {
+			mockClient := mock.NewMockClient(ctrl)
+			fileManager := mock.MockFileWriter{Writers: map[string]mock.MockWriter{}, Mkdirs: map[string]os.FileMode{}}
+			mb, err := mailbox.NewMailbox(
+				mailbox.WithClient(mockClient),
+				mailbox.WithLogger(mock.SetupLogger(t)),
+				mailbox.WithCtx(context.Background()),
+				mailbox.WithLoginFn(func() (base.Client, error) { return mockClient, nil }),
+				mailbox.WithLogoutFn(func() error { return nil }),
+				mailbox.WithFileManager(fileManager),
+				mailbox.WithExportFormat(tc.format),
+			)
+			if err != nil {
+				t.Fatalf("NewMailbox() error %+v", err)
+			}
+			mb.SerializedMailbox = base.SerializedMailbox{Name: "INBOX", Lifespan: 30, Exportable: true, Deletable: true}
+
+			messages := newMessages()
+			mockClient.EXPECT().Select("INBOX", false).Return(&imap.MailboxStatus{Messages: uint32(len(messages))}, nil)
+			mockClient.EXPECT().Search(gomock.Any()).Return([]uint32{1, 2}, nil)
+			mockClient.EXPECT().Fetch(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+				func(seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+					defer close(ch)
+					for _, msg := range messages {
+						ch <- msg
+					}
+					return nil
+				},
+			)
+			exportedSeqSet := new(imap.SeqSet)
+			exportedSeqSet.AddNum(1, 2)
+			mockClient.EXPECT().Store(exportedSeqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil).Return(nil)
+			mockClient.EXPECT().Expunge(nil).Return(nil)
+
+			if err := mb.ProcessMailbox(); err != nil {
+				t.Fatalf("ProcessMailbox() error %+v", err)
+			}
+
+			if len(fileManager.Writers) != len(tc.wantFiles) {
+				t.Fatalf("Incorrect file count. want: %d got: %d", len(tc.wantFiles), len(fileManager.Writers))
+			}
+			for pattern, want := range tc.wantFiles {
+				found := false
+				for name, writer := range fileManager.Writers {
+					if ok, _ := path.Match("exportedemails/"+pattern, name); ok {
+						found = true
+						if got := writer.Buffer.String(); got != want {
+							t.Errorf("Incorrect contents of %s. want: %q got: %q", name, want, got)
+						}
+					}
+				}
+				if !found {
+					t.Errorf("No file matches %s", pattern)
+				}
+			}
+
+			if tc.format == mailbox.ExportFormatMaildir {
+				for _, subfolder := range []string{"cur", "new", "tmp"} {
+					if _, ok := fileManager.Mkdirs["exportedemails/INBOX/"+subfolder]; !ok {
+						t.Errorf("Maildir folder %s was not created", subfolder)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWithExportFormatRejectsUnknownFormats(t *testing.T) {
+	mb := &mailbox.MailboxImpl{}
+	if err := mailbox.WithExportFormat("pst")(mb); err == nil {
+		t.Fatal("WithExportFormat() accepted an unknown format")
+	}
+}
+
+func TestProcessMailboxQuarantines(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockClient := mock.NewMockClient(ctrl)
+	mb, err := mailbox.NewMailbox(
+		mailbox.WithClient(mockClient),
+		mailbox.WithLogger(mock.SetupLogger(t)),
+		mailbox.WithCtx(context.Background()),
+		mailbox.WithLoginFn(func() (base.Client, error) { return mockClient, nil }),
+		mailbox.WithLogoutFn(func() error { return nil }),
+		mailbox.WithFileManager(mock.MockFileWriter{}),
+		mailbox.WithQuarantine("Quarantine", 14*24*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("NewMailbox() error %+v", err)
+	}
+	mb.SerializedMailbox = base.SerializedMailbox{Name: "INBOX", Lifespan: 30, Deletable: true}
+
+	messages := []*imap.Message{
+		{SeqNum: 1, Envelope: &imap.Envelope{MessageId: "<one@example.com>"}},
+		// Without a Message-ID sweep couldn't find the message again, so it stays put
+		{SeqNum: 2, Envelope: &imap.Envelope{}},
+		{SeqNum: 3, Envelope: &imap.Envelope{MessageId: "<three@example.com>"}},
+	}
+	mockClient.EXPECT().Select("INBOX", false).Return(&imap.MailboxStatus{Messages: 3}, nil)
+	mockClient.EXPECT().Search(gomock.Any()).Return([]uint32{1, 2, 3}, nil)
+	mockClient.EXPECT().Fetch(gomock.Any(), []imap.FetchItem{imap.FetchEnvelope}, gomock.Any()).DoAndReturn(
+		func(seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+			defer close(ch)
+			for _, msg := range messages {
+				ch <- msg
+			}
+			return nil
+		},
+	)
+	movedSeqSet := new(imap.SeqSet)
+	movedSeqSet.AddNum(1, 3)
+	mockClient.EXPECT().Move(movedSeqSet, "Quarantine").Return(nil)
+
+	before := time.Now()
+	if err := mb.ProcessMailbox(); err != nil {
+		t.Fatalf("ProcessMailbox() error %+v", err)
+	}
+
+	if len(mb.Quarantined) != 2 {
+		t.Fatalf("Incorrect quarantined count. want: 2 got: %d", len(mb.Quarantined))
+	}
+	for i, wantId := range []string{"<one@example.com>", "<three@example.com>"} {
+		got := mb.Quarantined[i]
+		if got.MessageId != wantId || got.MailboxName != "INBOX" {
+			t.Errorf("Incorrect quarantined message %d: %+v", i, got)
+		}
+		if expiry := got.ExpiresAt.Sub(got.QuarantinedAt); expiry != 14*24*time.Hour || got.QuarantinedAt.Before(before) {
+			t.Errorf("Incorrect quarantine times %d: %+v", i, got)
+		}
+	}
+}
+
+func TestSweepQuarantine(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	quarantined := []mailbox.QuarantinedMessage{
+		{MailboxName: "INBOX", MessageId: "<expired@example.com>", ExpiresAt: now.Add(-time.Hour)},
+		{MailboxName: "INBOX", MessageId: "<waiting@example.com>", ExpiresAt: now.Add(time.Hour)},
+		// Quarantined again from another mailbox, so it isn't due until the later entry expires
+		{MailboxName: "INBOX", MessageId: "<twice@example.com>", ExpiresAt: now.Add(-time.Hour)},
+		{MailboxName: "Archive", MessageId: "<twice@example.com>", ExpiresAt: now.Add(time.Hour)},
+	}
+
+	tests := []struct {
+		name          string
+		dryRun        bool
+		uidplus       bool
+		otherDeleted  bool
+		wantErr       bool
+		wantRemaining int
+	}{
+		{name: "Expunges only the expired messages", uidplus: true, wantRemaining: 3},
+		{name: "Expunges without UIDPLUS when nothing else is flagged", wantRemaining: 3},
+		{name: "Refuses without UIDPLUS when other messages are flagged", otherDeleted: true, wantErr: true},
+		{name: "Dry run keeps everything", dryRun: true, wantRemaining: 4},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockClient := mock.NewMockClient(ctrl)
+			mb := &mailbox.MailboxImpl{
+				SerializedMailbox: base.SerializedMailbox{Name: "Quarantine", Deletable: true},
+				LoginFn:           func() (base.Client, error) { return mockClient, nil },
+				LogoutFn:          func() error { return nil },
+				Client:            mockClient,
+				Logger:            mock.SetupLogger(t),
+				Ctx:               context.Background(),
+				FileManager:       mock.MockFileWriter{},
+				ProtectedFlags:    []string{imap.FlaggedFlag},
+				DryRun:            tc.dryRun,
+			}
+
+			// A dry run opens the folder with EXAMINE
+			mockClient.EXPECT().Select("Quarantine", tc.dryRun).Return(&imap.MailboxStatus{Name: "Quarantine", Messages: 5, ReadOnly: tc.dryRun}, nil)
+			mockClient.EXPECT().UidSearch(gomock.Any()).DoAndReturn(func(criteria *imap.SearchCriteria) ([]uint32, error) {
+				assert.Equal(t, "<expired@example.com>", criteria.Header.Get("Message-Id"))
+				assert.Equal(t, []string{imap.FlaggedFlag}, criteria.WithoutFlags, "protected messages are excluded")
+				return []uint32{40}, nil
+			})
+
+			sweptUids := new(imap.SeqSet)
+			sweptUids.AddNum(40)
+			if !tc.dryRun {
+				mockClient.EXPECT().Support("UIDPLUS").Return(tc.uidplus, nil)
+			}
+			if !tc.dryRun && !tc.uidplus {
+				// Without UIDPLUS, EXPUNGE is only safe when no other message is flagged \Deleted
+				flagged := []uint32{40}
+				if tc.otherDeleted {
+					flagged = append(flagged, 41)
+				}
+				mockClient.EXPECT().UidSearch(gomock.Any()).DoAndReturn(func(criteria *imap.SearchCriteria) ([]uint32, error) {
+					assert.Equal(t, []string{imap.DeletedFlag}, criteria.WithFlags)
+					return flagged, nil
+				})
+			}
+			if !tc.dryRun && !tc.otherDeleted {
+				mockClient.EXPECT().UidStore(sweptUids, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil).Return(nil)
+				if tc.uidplus {
+					mockClient.EXPECT().UidExpunge(sweptUids, nil).Return(nil)
+				} else {
+					mockClient.EXPECT().Expunge(nil).Return(nil)
+				}
+			}
+
+			remaining, deleted, err := mb.SweepQuarantine(quarantined, now)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, 1, deleted)
+			assert.Len(t, remaining, tc.wantRemaining)
+			for _, entry := range remaining {
+				if !tc.dryRun {
+					assert.NotEqual(t, "<expired@example.com>", entry.MessageId, "swept message is still in quarantine")
+				}
+			}
+		})
+	}
+}
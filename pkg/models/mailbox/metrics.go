@@ -0,0 +1,45 @@
+package mailbox
+
+import (
+	"aaronromeo.com/postmanpat/pkg/base"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	meter = otel.Meter(base.OTEL_NAME)
+
+	exportedMessagesCnt metric.Int64Counter
+	exportedBytesCnt    metric.Int64Counter
+	exportDurationHist  metric.Float64Histogram
+)
+
+func init() {
+	var err error
+	exportedMessagesCnt, err = meter.Int64Counter(
+		"postmanpat.export.messages",
+		metric.WithDescription("The number of messages exported"),
+		metric.WithUnit("{message}"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	exportedBytesCnt, err = meter.Int64Counter(
+		"postmanpat.export.bytes",
+		metric.WithDescription("The number of bytes written to storage by exports"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	exportDurationHist, err = meter.Float64Histogram(
+		"postmanpat.export.duration",
+		metric.WithDescription("The time taken to export a mailbox"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
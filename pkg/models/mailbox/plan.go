@@ -0,0 +1,127 @@
+package mailbox
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"aaronromeo.com/postmanpat/pkg/utils"
+	"github.com/emersion/go-imap"
+	"github.com/pkg/errors"
+)
+
+const (
+	PlanActionExportAndDelete     = "export_and_delete"
+	PlanActionDelete              = "delete"
+	PlanActionExportAndQuarantine = "export_and_quarantine"
+	PlanActionQuarantine          = "quarantine"
+)
+
+// PlannedAction is a message a dry run found which a real run would reap. The UID only identifies
+// the message while the mailbox keeps the same UIDValidity.
+type PlannedAction struct {
+	MailboxName  string    `json:"mailboxName"`
+	UIDValidity  uint32    `json:"uidValidity"`
+	UID          uint32    `json:"uid"`
+	Action       string    `json:"action"`
+	Subject      string    `json:"subject"`
+	MessageId    string    `json:"messageId"`
+	InternalDate time.Time `json:"internalDate"`
+	SentDate     time.Time `json:"sentDate"`
+	Reason       string    `json:"reason"`
+}
+
+// SortPlan orders a plan by mailbox and then UID, so plans of the same mailboxes compare line by line
+func SortPlan(plan []PlannedAction) {
+	sort.Slice(plan, func(i, j int) bool {
+		if plan[i].MailboxName != plan[j].MailboxName {
+			return plan[i].MailboxName < plan[j].MailboxName
+		}
+		return plan[i].UID < plan[j].UID
+	})
+}
+
+// PlanMessages finds the messages ProcessMailbox would reap and records them in Plan, without
+// exporting, flagging or expunging anything. Only the envelopes are fetched.
+func (mb *MailboxImpl) PlanMessages() error {
+	// Defer logout
+	defer mb.wrappedLogoutFn()()
+
+	mb.Plan = nil
+	if !mb.Deletable {
+		mb.Logger.InfoContext(mb.Ctx, "Skipping mailbox", slog.String("name", mb.Name))
+		return nil
+	}
+
+	// Login
+	c, err := mb.LoginFn()
+	if err != nil {
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return err
+	}
+	mb.Client = c
+
+	seqSet, err := mb.searchMessages()
+	if err != nil {
+		return err
+	}
+
+	action := PlanActionDelete
+	switch {
+	case mb.Exportable && mb.QuarantineFolder != "":
+		action = PlanActionExportAndQuarantine
+	case mb.Exportable:
+		action = PlanActionExportAndDelete
+	case mb.QuarantineFolder != "":
+		action = PlanActionQuarantine
+	}
+	reason := mb.planReason(time.Now())
+
+	messages, done := mb.fetchMessages(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchInternalDate})
+	// An empty set leaves messages nil, which would block forever
+	if messages != nil {
+		for msg := range messages {
+			planned := PlannedAction{
+				MailboxName:  mb.Name,
+				UIDValidity:  mb.uidValidity,
+				UID:          msg.Uid,
+				Action:       action,
+				InternalDate: msg.InternalDate,
+				Reason:       reason,
+			}
+			if msg.Envelope != nil {
+				planned.Subject = mb.Redactor.Redact(msg.Envelope.Subject)
+				planned.MessageId = mb.Redactor.Redact(msg.Envelope.MessageId)
+				planned.SentDate = msg.Envelope.Date
+			}
+			mb.Plan = append(mb.Plan, planned)
+			mb.Logger.InfoContext(
+				mb.Ctx,
+				"Dry run, message would be reaped",
+				slog.String("mailbox", mb.Name),
+				slog.Any("uid", planned.UID),
+				slog.String("action", planned.Action),
+				slog.String("subject", planned.Subject),
+				slog.String("reason", planned.Reason),
+			)
+		}
+	}
+	if err := <-done; err != nil {
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return errors.Wrapf(err, "fetching envelopes from %s", mb.Name)
+	}
+
+	SortPlan(mb.Plan)
+	return nil
+}
+
+// planReason explains which setting selected the messages
+func (mb *MailboxImpl) planReason(now time.Time) string {
+	dated := "received"
+	if mb.AgeBasis == base.AgeBasisHeader {
+		dated = "sent"
+	}
+	return fmt.Sprintf("lifespan of %d days, %s before %s", mb.Lifespan, dated, mb.cutoff(now).Format(time.DateOnly))
+}
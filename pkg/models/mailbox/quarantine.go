@@ -0,0 +1,217 @@
+package mailbox
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"aaronromeo.com/postmanpat/pkg/utils"
+	"github.com/emersion/go-imap"
+	"github.com/pkg/errors"
+)
+
+// QuarantinedMessage is a message moved to the quarantine folder instead of being deleted. Its
+// UID changes with the move, so the Message-ID is how SweepQuarantine finds it again.
+type QuarantinedMessage struct {
+	MailboxName   string    `json:"mailboxName"`
+	MessageId     string    `json:"messageId"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+}
+
+// WithQuarantine moves the messages which would be deleted to folder, where SweepQuarantine deletes
+// them once expiry has passed. An empty folder deletes messages straight away.
+func WithQuarantine(folder string, expiry time.Duration) MailboxOption {
+	return func(mb *MailboxImpl) error {
+		if folder != "" && expiry <= 0 {
+			return errors.Errorf("quarantine expiry must be positive, got %s", expiry)
+		}
+		mb.QuarantineFolder = folder
+		mb.QuarantineExpiry = expiry
+		return nil
+	}
+}
+
+// quarantineMessages moves the messages in the set to the quarantine folder and records them in
+// Quarantined. Messages without a Message-ID couldn't be found again to be swept, so they are
+// left where they are.
+func (mb *MailboxImpl) quarantineMessages(c base.Client, seqSet *imap.SeqSet) error {
+	if seqSet.Empty() {
+		return nil
+	}
+	if base.NormalizeMailboxName(mb.Name) == base.NormalizeMailboxName(mb.QuarantineFolder) {
+		return errors.Errorf("mailbox %s is the quarantine folder, its messages are deleted by sweep", mb.Name)
+	}
+
+	now := time.Now()
+	moveSeqSet := new(imap.SeqSet)
+	quarantined := []QuarantinedMessage{}
+	messages, done := mb.fetchMessages(seqSet, []imap.FetchItem{imap.FetchEnvelope})
+	for msg := range messages {
+		if msg.Envelope == nil || msg.Envelope.MessageId == "" {
+			mb.Logger.WarnContext(mb.Ctx, "Leaving a message without a Message-ID out of quarantine", slog.String("mailbox", mb.Name), slog.Any("seqNum", msg.SeqNum))
+			continue
+		}
+		moveSeqSet.AddNum(msg.SeqNum)
+		quarantined = append(quarantined, QuarantinedMessage{
+			MailboxName:   mb.Name,
+			MessageId:     msg.Envelope.MessageId,
+			QuarantinedAt: now,
+			ExpiresAt:     now.Add(mb.QuarantineExpiry),
+		})
+	}
+	if err := <-done; err != nil {
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return errors.Wrapf(err, "fetching message IDs from %s", mb.Name)
+	}
+
+	if moveSeqSet.Empty() {
+		return nil
+	}
+	if err := c.Move(moveSeqSet, mb.QuarantineFolder); err != nil {
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return errors.Wrapf(err, "moving messages from %s to the quarantine folder %s, make sure it exists", mb.Name, mb.QuarantineFolder)
+	}
+	mb.Quarantined = append(mb.Quarantined, quarantined...)
+	mb.Logger.Info(mb.Name, "Quarantined messages count", len(quarantined))
+
+	return nil
+}
+
+// SweepQuarantine deletes the quarantined messages whose expiry has passed from this mailbox,
+// which is the quarantine folder, and returns the entries still waiting along with the number of
+// messages deleted. Messages which were flagged as protected or moved out of quarantine are kept
+// and their entries dropped. A dry run deletes nothing and keeps every entry.
+func (mb *MailboxImpl) SweepQuarantine(quarantined []QuarantinedMessage, now time.Time) ([]QuarantinedMessage, int, error) {
+	// A message quarantined twice is only due once every entry for it has expired
+	due := map[string]bool{}
+	for _, entry := range quarantined {
+		if _, seen := due[entry.MessageId]; !seen {
+			due[entry.MessageId] = true
+		}
+		if now.Before(entry.ExpiresAt) {
+			due[entry.MessageId] = false
+		}
+	}
+
+	remaining := []QuarantinedMessage{}
+	dueIds := []string{}
+	for _, entry := range quarantined {
+		if !due[entry.MessageId] {
+			remaining = append(remaining, entry)
+		}
+	}
+	for messageId, isDue := range due {
+		if isDue {
+			dueIds = append(dueIds, messageId)
+		}
+	}
+	if len(dueIds) == 0 {
+		return remaining, 0, nil
+	}
+	sort.Strings(dueIds)
+
+	// Defer logout
+	defer mb.wrappedLogoutFn()()
+
+	// Login
+	c, err := mb.LoginFn()
+	if err != nil {
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return nil, 0, err
+	}
+	mb.Client = c
+
+	// A dry run only reads the folder, so it is opened with EXAMINE
+	mbox, err := c.Select(mb.Name, mb.DryRun)
+	if err != nil {
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return nil, 0, errors.Wrapf(err, "selecting the quarantine folder %s", mb.Name)
+	}
+	if !mb.DryRun {
+		if err := checkDeletable(mbox); err != nil {
+			mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+			return nil, 0, err
+		}
+	}
+
+	uidSet := new(imap.SeqSet)
+	found := 0
+	for _, messageId := range dueIds {
+		if err := mb.ctxErr(); err != nil {
+			return nil, 0, err
+		}
+
+		criteria := imap.NewSearchCriteria()
+		criteria.Header.Add("Message-Id", messageId)
+		criteria.WithoutFlags = append(criteria.WithoutFlags, mb.ProtectedFlags...)
+		uids, err := c.UidSearch(criteria)
+		if err != nil {
+			mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+			return nil, 0, errors.Wrapf(err, "searching %s", mb.Name)
+		}
+		uidSet.AddNum(uids...)
+		found += len(uids)
+	}
+
+	if mb.DryRun {
+		mb.Logger.InfoContext(mb.Ctx, "Dry run, quarantined messages would be deleted", slog.String("mailbox", mb.Name), slog.Int("count", found))
+		return quarantined, found, nil
+	}
+
+	if err := mb.expungeUids(c, uidSet); err != nil {
+		return nil, 0, err
+	}
+	mb.Logger.Info(mb.Name, "Swept messages count", found)
+
+	return remaining, found, nil
+}
+
+// expungeUids deletes just the messages in the UID set. UID EXPUNGE leaves any other message
+// flagged \Deleted alone, without UIDPLUS a plain EXPUNGE is only sent when no other message is
+// flagged, so nothing else in the folder is deleted along with them.
+func (mb *MailboxImpl) expungeUids(c base.Client, uidSet *imap.SeqSet) error {
+	if uidSet.Empty() {
+		return nil
+	}
+
+	uidplus, err := c.Support("UIDPLUS")
+	if err != nil {
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return err
+	}
+	if !uidplus {
+		criteria := imap.NewSearchCriteria()
+		criteria.WithFlags = []string{imap.DeletedFlag}
+		flagged, err := c.UidSearch(criteria)
+		if err != nil {
+			mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+			return errors.Wrapf(err, "searching %s", mb.Name)
+		}
+		for _, uid := range flagged {
+			if !uidSet.Contains(uid) {
+				return errors.Errorf("%s has other messages flagged %s and the server doesn't support UIDPLUS, expunge them before sweeping", mb.Name, imap.DeletedFlag)
+			}
+		}
+	}
+
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	flags := []interface{}{imap.DeletedFlag}
+	if err := c.UidStore(uidSet, item, flags, nil); err != nil {
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return errors.Wrapf(err, "marking messages in %s as deleted", mb.Name)
+	}
+
+	if uidplus {
+		err = c.UidExpunge(uidSet, nil)
+	} else {
+		err = c.Expunge(nil)
+	}
+	if err != nil {
+		mb.Logger.ErrorContext(mb.Ctx, err.Error(), slog.Any("error", utils.WrapError(err)))
+		return errors.Wrapf(err, "expunging %s", mb.Name)
+	}
+
+	return nil
+}
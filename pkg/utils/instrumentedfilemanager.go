@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	storageMeter = otel.Meter(base.OTEL_NAME)
+
+	storageOperationsCnt metric.Int64Counter
+	storageBytesCnt      metric.Int64Counter
+	storageDurationHist  metric.Float64Histogram
+	storageErrorsCnt     metric.Int64Counter
+)
+
+func init() {
+	var err error
+	storageOperationsCnt, err = storageMeter.Int64Counter(
+		"postmanpat.storage.operations",
+		metric.WithDescription("The number of storage operations, each write is one object"),
+		metric.WithUnit("{operation}"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	storageBytesCnt, err = storageMeter.Int64Counter(
+		"postmanpat.storage.bytes",
+		metric.WithDescription("The number of bytes read from or written to storage"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	storageDurationHist, err = storageMeter.Float64Histogram(
+		"postmanpat.storage.duration",
+		metric.WithDescription("The time taken by a storage operation"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	storageErrorsCnt, err = storageMeter.Int64Counter(
+		"postmanpat.storage.errors",
+		metric.WithDescription("The number of failed storage operations"),
+		metric.WithUnit("{error}"),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// InstrumentedFileManager records the count, size, latency and failures of every operation on the
+// wrapped FileManager, so slow runs can be put down to storage or to IMAP
+type InstrumentedFileManager struct {
+	FileManager
+	backend string
+}
+
+// NewInstrumentedFileManager wraps fileManager, labelling its metrics with the backend, e.g. "s3"
+func NewInstrumentedFileManager(fileManager FileManager, backend string) *InstrumentedFileManager {
+	return &InstrumentedFileManager{FileManager: fileManager, backend: backend}
+}
+
+// record adds an operation which started at start and moved size bytes
+func (ifm *InstrumentedFileManager) record(operation string, start time.Time, size int, err error) {
+	ctx := context.Background()
+	attrs := metric.WithAttributes(
+		attribute.String("storage.backend", ifm.backend),
+		attribute.String("storage.operation", operation),
+	)
+
+	storageOperationsCnt.Add(ctx, 1, attrs)
+	storageDurationHist.Record(ctx, time.Since(start).Seconds(), attrs)
+	if err != nil {
+		storageErrorsCnt.Add(ctx, 1, attrs)
+		return
+	}
+	if size > 0 {
+		storageBytesCnt.Add(ctx, int64(size), attrs)
+	}
+}
+
+func (ifm *InstrumentedFileManager) Create(name string) (Writer, error) {
+	start := time.Now()
+	writer, err := ifm.FileManager.Create(name)
+	if err != nil {
+		ifm.record("write", start, 0, err)
+		return nil, err
+	}
+	return &instrumentedWriter{Writer: writer, ifm: ifm, start: start}, nil
+}
+
+func (ifm *InstrumentedFileManager) Open(name string) (io.ReadCloser, error) {
+	start := time.Now()
+	reader, err := ifm.FileManager.Open(name)
+	// A missing file is an answer rather than a storage failure
+	if IsNotExist(err) {
+		ifm.record("read", start, 0, nil)
+		return nil, err
+	}
+	if err != nil {
+		ifm.record("read", start, 0, err)
+		return nil, err
+	}
+	return &instrumentedReader{ReadCloser: reader, ifm: ifm, start: start}, nil
+}
+
+func (ifm *InstrumentedFileManager) MkdirAll(path string, perm os.FileMode) error {
+	start := time.Now()
+	err := ifm.FileManager.MkdirAll(path, perm)
+	ifm.record("mkdir", start, 0, err)
+	return err
+}
+
+func (ifm *InstrumentedFileManager) WriteFile(filename string, data []byte, perm os.FileMode) error {
+	start := time.Now()
+	err := ifm.FileManager.WriteFile(filename, data, perm)
+	ifm.record("write", start, len(data), err)
+	return err
+}
+
+func (ifm *InstrumentedFileManager) ReadFile(filename string) ([]byte, error) {
+	start := time.Now()
+	data, err := ifm.FileManager.ReadFile(filename)
+	// A missing file is an answer rather than a storage failure
+	if IsNotExist(err) {
+		ifm.record("read", start, 0, nil)
+		return data, err
+	}
+	ifm.record("read", start, len(data), err)
+	return data, err
+}
+
+// instrumentedWriter records a file written with Create as one write, timed from Create to Close
+type instrumentedWriter struct {
+	Writer
+	ifm   *InstrumentedFileManager
+	start time.Time
+	size  int
+	err   error
+}
+
+func (iw *instrumentedWriter) Write(p []byte) (int, error) {
+	n, err := iw.Writer.Write(p)
+	iw.size += n
+	if err != nil && iw.err == nil {
+		iw.err = err
+	}
+	return n, err
+}
+
+func (iw *instrumentedWriter) Close() error {
+	err := iw.Writer.Close()
+	if iw.err != nil {
+		iw.ifm.record("write", iw.start, iw.size, iw.err)
+	} else {
+		iw.ifm.record("write", iw.start, iw.size, err)
+	}
+	return err
+}
+
+// instrumentedReader records a file read with Open as one read, timed from Open to Close
+type instrumentedReader struct {
+	io.ReadCloser
+	ifm   *InstrumentedFileManager
+	start time.Time
+	size  int
+	err   error
+}
+
+func (ir *instrumentedReader) Read(p []byte) (int, error) {
+	n, err := ir.ReadCloser.Read(p)
+	ir.size += n
+	if err != nil && !errors.Is(err, io.EOF) && ir.err == nil {
+		ir.err = err
+	}
+	return n, err
+}
+
+func (ir *instrumentedReader) Close() error {
+	ir.ifm.record("read", ir.start, ir.size, ir.err)
+	return ir.ReadCloser.Close()
+}
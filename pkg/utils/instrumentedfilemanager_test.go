@@ -0,0 +1,205 @@
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"aaronromeo.com/postmanpat/pkg/mock"
+	"aaronromeo.com/postmanpat/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+var (
+	metricReaderOnce sync.Once
+	metricReader     *sdkmetric.ManualReader
+)
+
+// storageMetrics collects the storage counters recorded for the test backend, keyed by metric
+// name and then operation. The global meter provider can only be set once, so the counters are
+// cumulative across tests and each test compares against a snapshot.
+func storageMetrics(t *testing.T, backend string) map[string]map[string]int64 {
+	t.Helper()
+	metricReaderOnce.Do(func() {
+		metricReader = sdkmetric.NewManualReader()
+		otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(metricReader)))
+	})
+
+	var rm metricdata.ResourceMetrics
+	assert.NoError(t, metricReader.Collect(context.Background(), &rm))
+
+	values := map[string]map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			sum, ok := m.Data.(metricdata.Sum[int64])
+			if !ok {
+				continue
+			}
+			for _, dp := range sum.DataPoints {
+				if got, _ := dp.Attributes.Value(attribute.Key("storage.backend")); got.AsString() != backend {
+					continue
+				}
+				operation, _ := dp.Attributes.Value(attribute.Key("storage.operation"))
+				if values[m.Name] == nil {
+					values[m.Name] = map[string]int64{}
+				}
+				values[m.Name][operation.AsString()] += dp.Value
+			}
+		}
+	}
+	return values
+}
+
+// storageDelta is how much each storage counter for the operation grew while fn ran
+func storageDelta(t *testing.T, backend, operation string, fn func()) map[string]int64 {
+	t.Helper()
+	before := storageMetrics(t, backend)
+	fn()
+	after := storageMetrics(t, backend)
+
+	delta := map[string]int64{}
+	for _, name := range []string{"postmanpat.storage.operations", "postmanpat.storage.bytes", "postmanpat.storage.errors"} {
+		delta[name] = after[name][operation] - before[name][operation]
+	}
+	return delta
+}
+
+func TestInstrumentedFileManagerWriteFile(t *testing.T) {
+	ifm := utils.NewInstrumentedFileManager(mock.MockFileWriter{Writers: map[string]mock.MockWriter{}}, t.Name())
+	delta := storageDelta(t, t.Name(), "write", func() {
+		assert.NoError(t, ifm.WriteFile("workingfiles/mailboxlist.json", []byte("{}\n"), 0644))
+	})
+	assert.Equal(t, map[string]int64{
+		"postmanpat.storage.operations": 1,
+		"postmanpat.storage.bytes":      3,
+		"postmanpat.storage.errors":     0,
+	}, delta)
+
+	failing := utils.NewInstrumentedFileManager(mock.MockFileWriter{Writers: map[string]mock.MockWriter{}, Err: errors.New("disk full")}, t.Name())
+	delta = storageDelta(t, t.Name(), "write", func() {
+		assert.Error(t, failing.WriteFile("workingfiles/mailboxlist.json", []byte("{}\n"), 0644))
+	})
+	assert.Equal(t, map[string]int64{
+		"postmanpat.storage.operations": 1,
+		"postmanpat.storage.bytes":      0,
+		"postmanpat.storage.errors":     1,
+	}, delta)
+}
+
+func TestInstrumentedFileManagerCreate(t *testing.T) {
+	ifm := utils.NewInstrumentedFileManager(mock.MockFileWriter{Writers: map[string]mock.MockWriter{}}, t.Name())
+
+	// The file is one write, counted once it closes
+	delta := storageDelta(t, t.Name(), "write", func() {
+		writer, err := ifm.Create("exportedemails/INBOX.mbox")
+		assert.NoError(t, err)
+		_, err = writer.Write([]byte("From "))
+		assert.NoError(t, err)
+		_, err = writer.Write([]byte("clark@example.com\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Close())
+	})
+	assert.Equal(t, map[string]int64{
+		"postmanpat.storage.operations": 1,
+		"postmanpat.storage.bytes":      23,
+		"postmanpat.storage.errors":     0,
+	}, delta)
+}
+
+func TestInstrumentedFileManagerReads(t *testing.T) {
+	backend := t.Name()
+	fileMgr := mock.MockFileWriter{Writers: map[string]mock.MockWriter{}}
+	assert.NoError(t, fileMgr.WriteFile("workingfiles/mailboxlist.json", []byte("{}\n"), 0644))
+	ifm := utils.NewInstrumentedFileManager(fileMgr, backend)
+
+	tests := []struct {
+		name      string
+		read      func(name string) error
+		file      string
+		wantErr   bool
+		wantDelta map[string]int64
+	}{
+		{
+			name: "ReadFile",
+			read: func(name string) error {
+				_, err := ifm.ReadFile(name)
+				return err
+			},
+			file:      "workingfiles/mailboxlist.json",
+			wantDelta: map[string]int64{"postmanpat.storage.operations": 1, "postmanpat.storage.bytes": 3, "postmanpat.storage.errors": 0},
+		},
+		{
+			name: "Open",
+			read: func(name string) error {
+				reader, err := ifm.Open(name)
+				if err != nil {
+					return err
+				}
+				if _, err := io.ReadAll(reader); err != nil {
+					return err
+				}
+				return reader.Close()
+			},
+			file:      "workingfiles/mailboxlist.json",
+			wantDelta: map[string]int64{"postmanpat.storage.operations": 1, "postmanpat.storage.bytes": 3, "postmanpat.storage.errors": 0},
+		},
+		{
+			// A missing file is an answer, such as there being no lease yet, not a storage failure
+			name: "ReadFile missing file",
+			read: func(name string) error {
+				_, err := ifm.ReadFile(name)
+				return err
+			},
+			file:      "workingfiles/lease.json",
+			wantErr:   true,
+			wantDelta: map[string]int64{"postmanpat.storage.operations": 1, "postmanpat.storage.bytes": 0, "postmanpat.storage.errors": 0},
+		},
+		{
+			name: "Open missing file",
+			read: func(name string) error {
+				_, err := ifm.Open(name)
+				return err
+			},
+			file:      "workingfiles/lease.json",
+			wantErr:   true,
+			wantDelta: map[string]int64{"postmanpat.storage.operations": 1, "postmanpat.storage.bytes": 0, "postmanpat.storage.errors": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delta := storageDelta(t, backend, "read", func() {
+				err := tt.read(tt.file)
+				if tt.wantErr {
+					assert.True(t, utils.IsNotExist(err))
+				} else {
+					assert.NoError(t, err)
+				}
+			})
+			assert.Equal(t, tt.wantDelta, delta)
+		})
+	}
+}
+
+func TestInstrumentedFileManagerReadFailure(t *testing.T) {
+	fileMgr := mock.MockFileWriter{Writers: map[string]mock.MockWriter{}}
+	assert.NoError(t, fileMgr.WriteFile("workingfiles/mailboxlist.json", []byte("{}\n"), 0644))
+	fileMgr.Err = errors.New("connection reset")
+	ifm := utils.NewInstrumentedFileManager(fileMgr, t.Name())
+
+	delta := storageDelta(t, t.Name(), "read", func() {
+		_, err := ifm.ReadFile("workingfiles/mailboxlist.json")
+		assert.Error(t, err)
+	})
+	assert.Equal(t, map[string]int64{
+		"postmanpat.storage.operations": 1,
+		"postmanpat.storage.bytes":      0,
+		"postmanpat.storage.errors":     1,
+	}, delta)
+}
@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLeaseHeld is returned when another run holds a lease which hasn't expired
+var ErrLeaseHeld = errors.New("lease is held by another run")
+
+// Lease is a best-effort lock kept as a file in storage, so runs on different hosts sharing the
+// storage keep out of each other's way. Storage has no compare-and-swap, so a lease is written and
+// then read back. That catches a run which finds the lease held, or which reads back the other
+// run's lease, but it isn't mutual exclusion: two runs whose write and read back interleave can
+// both read back their own lease and both go ahead. Renewals narrow the window, as the run which
+// lost the lease stops at its next renewal, but nothing which must never run twice should rely on it.
+type Lease struct {
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+
+	fileManager FileManager
+	filename    string
+	ttl         time.Duration
+}
+
+// readLease reads the lease in the file, a missing file is an expired lease
+func readLease(fileManager FileManager, filename string) (Lease, error) {
+	var lease Lease
+	data, err := fileManager.ReadFile(filename)
+	if IsNotExist(err) {
+		return lease, nil
+	}
+	if err != nil {
+		return lease, errors.Wrapf(err, "reading lease %s", filename)
+	}
+
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return lease, errors.Wrapf(err, "lease %s is not valid", filename)
+	}
+	return lease, nil
+}
+
+func (l *Lease) write() error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(l.fileManager.WriteFile(l.filename, data, 0644), "writing lease %s", l.filename)
+}
+
+// AcquireLease takes the lease in filename for holder until ttl from now. A lease left behind by a
+// run that died is taken over once it expires. Two runs acquiring the lease at the same time may
+// both succeed, see Lease.
+func AcquireLease(fileManager FileManager, filename, holder string, ttl time.Duration) (*Lease, error) {
+	now := time.Now()
+	current, err := readLease(fileManager, filename)
+	if err != nil {
+		return nil, err
+	}
+	if current.Holder != "" && current.Holder != holder && now.Before(current.ExpiresAt) {
+		return nil, errors.Wrapf(ErrLeaseHeld, "%s since %s, it expires at %s", current.Holder, current.AcquiredAt.Format(time.RFC3339), current.ExpiresAt.Format(time.RFC3339))
+	}
+
+	lease := &Lease{
+		Holder:      holder,
+		AcquiredAt:  now,
+		ExpiresAt:   now.Add(ttl),
+		fileManager: fileManager,
+		filename:    filename,
+		ttl:         ttl,
+	}
+	if err := lease.write(); err != nil {
+		return nil, err
+	}
+
+	written, err := readLease(fileManager, filename)
+	if err != nil {
+		return nil, err
+	}
+	if written.Holder != holder {
+		return nil, errors.Wrapf(ErrLeaseHeld, "%s, which started at the same time", written.Holder)
+	}
+
+	return lease, nil
+}
+
+// Renew extends the lease by its ttl, failing when another run has taken it over in the meantime
+func (l *Lease) Renew() error {
+	current, err := readLease(l.fileManager, l.filename)
+	if err != nil {
+		return err
+	}
+	if current.Holder != l.Holder {
+		return errors.Wrapf(ErrLeaseHeld, "%s took the lease over", current.Holder)
+	}
+
+	l.ExpiresAt = time.Now().Add(l.ttl)
+	return l.write()
+}
+
+// KeepRenewed renews the lease every third of its ttl until stop is called or ctx is done. The
+// returned context is cancelled when a renewal fails, so the run stops before another one can
+// take the lease over. stop waits for a renewal underway, so none lands after Release.
+func (l *Lease) KeepRenewed(ctx context.Context, logger *slog.Logger) (leaseCtx context.Context, stop func()) {
+	leaseCtx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-leaseCtx.Done():
+				return
+			case <-ticker.C:
+				if err := l.Renew(); err != nil {
+					logger.ErrorContext(ctx, "Failed to renew the lease", slog.Any("error", WrapError(err)))
+					cancel(err)
+					return
+				}
+			}
+		}
+	}()
+	return leaseCtx, func() {
+		cancel(nil)
+		<-done
+	}
+}
+
+// Release hands the lease back by marking it expired, leaving a record of the last holder
+func (l *Lease) Release() error {
+	current, err := readLease(l.fileManager, l.filename)
+	if err != nil {
+		return err
+	}
+	if current.Holder != l.Holder {
+		return nil
+	}
+
+	l.ExpiresAt = time.Now()
+	return l.write()
+}
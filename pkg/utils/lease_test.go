@@ -0,0 +1,167 @@
+package utils_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"aaronromeo.com/postmanpat/pkg/mock"
+	"aaronromeo.com/postmanpat/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const leaseFile = "workingfiles/lease.json"
+
+func writeLease(t *testing.T, fileMgr mock.MockFileWriter, holder string, expiresAt time.Time) {
+	t.Helper()
+	data, err := json.Marshal(utils.Lease{Holder: holder, AcquiredAt: expiresAt.Add(-time.Hour), ExpiresAt: expiresAt})
+	assert.NoError(t, err)
+	assert.NoError(t, fileMgr.WriteFile(leaseFile, data, 0644))
+}
+
+func readLease(t *testing.T, fileMgr mock.MockFileWriter) utils.Lease {
+	t.Helper()
+	var lease utils.Lease
+	data, err := fileMgr.ReadFile(leaseFile)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &lease))
+	return lease
+}
+
+func TestAcquireLease(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T, fileMgr mock.MockFileWriter)
+		wantHolder string
+		wantErr    error
+	}{
+		{
+			name:       "free",
+			setup:      func(t *testing.T, fileMgr mock.MockFileWriter) {},
+			wantHolder: "host-a:1",
+		},
+		{
+			name: "held by another run",
+			setup: func(t *testing.T, fileMgr mock.MockFileWriter) {
+				writeLease(t, fileMgr, "host-b:2", time.Now().Add(time.Minute))
+			},
+			wantHolder: "host-b:2",
+			wantErr:    utils.ErrLeaseHeld,
+		},
+		{
+			name: "expired",
+			setup: func(t *testing.T, fileMgr mock.MockFileWriter) {
+				writeLease(t, fileMgr, "host-b:2", time.Now().Add(-time.Minute))
+			},
+			wantHolder: "host-a:1",
+		},
+		{
+			name: "already held by the same run",
+			setup: func(t *testing.T, fileMgr mock.MockFileWriter) {
+				writeLease(t, fileMgr, "host-a:1", time.Now().Add(time.Minute))
+			},
+			wantHolder: "host-a:1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileMgr := mock.MockFileWriter{Writers: map[string]mock.MockWriter{}}
+			tt.setup(t, fileMgr)
+
+			lease, err := utils.AcquireLease(fileMgr, leaseFile, "host-a:1", time.Minute)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Nil(t, lease)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "host-a:1", lease.Holder)
+				assert.WithinDuration(t, time.Now().Add(time.Minute), lease.ExpiresAt, 5*time.Second)
+			}
+			assert.Equal(t, tt.wantHolder, readLease(t, fileMgr).Holder)
+		})
+	}
+}
+
+func TestLeaseRenew(t *testing.T) {
+	fileMgr := mock.MockFileWriter{Writers: map[string]mock.MockWriter{}}
+	lease, err := utils.AcquireLease(fileMgr, leaseFile, "host-a:1", time.Minute)
+	assert.NoError(t, err)
+
+	firstExpiry := lease.ExpiresAt
+	time.Sleep(time.Millisecond)
+	assert.NoError(t, lease.Renew())
+	assert.True(t, lease.ExpiresAt.After(firstExpiry))
+	assert.Equal(t, lease.ExpiresAt.UTC(), readLease(t, fileMgr).ExpiresAt.UTC())
+
+	// Another run took the lease over, so this one has to stop rather than write it back
+	writeLease(t, fileMgr, "host-b:2", time.Now().Add(time.Minute))
+	assert.ErrorIs(t, lease.Renew(), utils.ErrLeaseHeld)
+	assert.Equal(t, "host-b:2", readLease(t, fileMgr).Holder)
+}
+
+func TestLeaseRelease(t *testing.T) {
+	fileMgr := mock.MockFileWriter{Writers: map[string]mock.MockWriter{}}
+	lease, err := utils.AcquireLease(fileMgr, leaseFile, "host-a:1", time.Minute)
+	assert.NoError(t, err)
+
+	assert.NoError(t, lease.Release())
+	released := readLease(t, fileMgr)
+	assert.Equal(t, "host-a:1", released.Holder, "the last holder is kept on record")
+	assert.False(t, time.Now().Before(released.ExpiresAt))
+
+	// Once released, another run can take the lease straight away
+	_, err = utils.AcquireLease(fileMgr, leaseFile, "host-b:2", time.Minute)
+	assert.NoError(t, err)
+}
+
+func TestLeaseReleaseLeavesAnotherHoldersLease(t *testing.T) {
+	fileMgr := mock.MockFileWriter{Writers: map[string]mock.MockWriter{}}
+	lease, err := utils.AcquireLease(fileMgr, leaseFile, "host-a:1", time.Minute)
+	assert.NoError(t, err)
+
+	expiresAt := time.Now().Add(time.Minute).Truncate(time.Second)
+	writeLease(t, fileMgr, "host-b:2", expiresAt)
+
+	assert.NoError(t, lease.Release())
+	current := readLease(t, fileMgr)
+	assert.Equal(t, "host-b:2", current.Holder)
+	assert.True(t, expiresAt.Equal(current.ExpiresAt))
+}
+
+func TestLeaseKeepRenewed(t *testing.T) {
+	logger := mock.SetupLogger(t)
+
+	t.Run("renews until stopped", func(t *testing.T) {
+		fileMgr := mock.MockFileWriter{Writers: map[string]mock.MockWriter{}}
+		lease, err := utils.AcquireLease(fileMgr, leaseFile, "host-a:1", 30*time.Millisecond)
+		assert.NoError(t, err)
+		firstExpiry := readLease(t, fileMgr).ExpiresAt
+
+		leaseCtx, stop := lease.KeepRenewed(context.Background(), logger)
+		time.Sleep(50 * time.Millisecond)
+		stop()
+
+		assert.ErrorIs(t, leaseCtx.Err(), context.Canceled)
+		assert.Equal(t, context.Canceled, context.Cause(leaseCtx), "stopping isn't a failure")
+		assert.True(t, readLease(t, fileMgr).ExpiresAt.After(firstExpiry))
+	})
+
+	t.Run("cancels the run once the lease is lost", func(t *testing.T) {
+		fileMgr := mock.MockFileWriter{Writers: map[string]mock.MockWriter{}}
+		lease, err := utils.AcquireLease(fileMgr, leaseFile, "host-a:1", 30*time.Millisecond)
+		assert.NoError(t, err)
+
+		writeLease(t, fileMgr, "host-b:2", time.Now().Add(time.Minute))
+		leaseCtx, stop := lease.KeepRenewed(context.Background(), logger)
+		defer stop()
+
+		select {
+		case <-leaseCtx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("the run wasn't cancelled after the lease was lost")
+		}
+		assert.ErrorIs(t, context.Cause(leaseCtx), utils.ErrLeaseHeld)
+	})
+}
@@ -13,7 +13,11 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutlog"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/log/global"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/log"
@@ -24,9 +28,43 @@ import (
 	"google.golang.org/grpc/encoding/gzip"
 )
 
+// OTelExporter selects where telemetry is sent
+type OTelExporter string
+
+const (
+	// OTelExporterNone leaves the global no-op providers in place
+	OTelExporterNone OTelExporter = "none"
+	// OTelExporterStdout writes telemetry to stdout, useful when debugging
+	OTelExporterStdout OTelExporter = "stdout"
+	// OTelExporterOTLP sends traces, metrics and logs over OTLP/HTTP to the endpoint and headers in
+	// the standard OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_HEADERS env vars
+	OTelExporterOTLP OTelExporter = "otlp"
+	// OTelExporterUptrace sends telemetry to Uptrace using the UPTRACE_DSN env var
+	OTelExporterUptrace OTelExporter = "uptrace"
+)
+
+// ParseOTelExporter validates the exporter name. When it is empty, Uptrace is used if
+// UPTRACE_DSN is set and telemetry is disabled otherwise.
+func ParseOTelExporter(exporter string) (OTelExporter, error) {
+	switch OTelExporter(exporter) {
+	case "":
+		if _, ok := os.LookupEnv(base.UPTRACE_DSN_ENV_VAR); ok {
+			return OTelExporterUptrace, nil
+		}
+		return OTelExporterNone, nil
+	case OTelExporterNone, OTelExporterStdout, OTelExporterOTLP, OTelExporterUptrace:
+		return OTelExporter(exporter), nil
+	default:
+		return "", fmt.Errorf(
+			"unknown OTel exporter %q, expected one of %q, %q, %q or %q",
+			exporter, OTelExporterNone, OTelExporterStdout, OTelExporterOTLP, OTelExporterUptrace,
+		)
+	}
+}
+
 // setupOTelSDK bootstraps the OpenTelemetry pipeline.
 // If it does not return an error, make sure to call shutdown for proper cleanup.
-func SetupOTelSDK(ctx context.Context) (shutdown func(context.Context) error, err error) {
+func SetupOTelSDK(ctx context.Context, exporter OTelExporter) (shutdown func(context.Context) error, err error) {
 	var shutdownFuncs []func(context.Context) error
 
 	// shutdown calls cleanup functions registered via shutdownFuncs.
@@ -46,6 +84,15 @@ func SetupOTelSDK(ctx context.Context) (shutdown func(context.Context) error, er
 		err = errors.Join(inErr, shutdown(ctx))
 	}
 
+	if exporter == OTelExporterNone {
+		return
+	}
+
+	if exporter == OTelExporterUptrace && os.Getenv(base.UPTRACE_DSN_ENV_VAR) == "" {
+		err = fmt.Errorf("%s environment variable is required", base.UPTRACE_DSN_ENV_VAR)
+		return
+	}
+
 	// Set up propagator.
 	prop := newPropagator()
 	otel.SetTextMapPropagator(prop)
@@ -64,7 +111,7 @@ func SetupOTelSDK(ctx context.Context) (shutdown func(context.Context) error, er
 	}
 
 	// Set up trace provider.
-	tracerProvider, err := newTraceProvider(ctx, resource)
+	tracerProvider, err := newTraceProvider(ctx, exporter, resource)
 	if err != nil {
 		handleErr(err)
 		return
@@ -74,7 +121,7 @@ func SetupOTelSDK(ctx context.Context) (shutdown func(context.Context) error, er
 	otel.SetTracerProvider(tracerProvider)
 
 	// Set up meter provider.
-	meterProvider, err := newMeterProvider(ctx, resource)
+	meterProvider, err := newMeterProvider(ctx, exporter, resource)
 	if err != nil {
 		handleErr(err)
 		return
@@ -83,7 +130,7 @@ func SetupOTelSDK(ctx context.Context) (shutdown func(context.Context) error, er
 	otel.SetMeterProvider(meterProvider)
 
 	// Set up logger provider.
-	loggerProvider, err := newLoggerProvider(ctx)
+	loggerProvider, err := newLoggerProvider(ctx, exporter)
 	if err != nil {
 		handleErr(err)
 		return
@@ -101,26 +148,27 @@ func newPropagator() propagation.TextMapPropagator {
 	)
 }
 
-func newTraceExporter(ctx context.Context) (trace.SpanExporter, error) {
-	dsn := os.Getenv(base.UPTRACE_DSN_ENV_VAR)
-	if dsn == "" {
-		panic(fmt.Sprintf("%s environment variable is required", base.UPTRACE_DSN_ENV_VAR))
+func newTraceExporter(ctx context.Context, exporter OTelExporter) (trace.SpanExporter, error) {
+	switch exporter {
+	case OTelExporterStdout:
+		return stdouttrace.New()
+	case OTelExporterOTLP:
+		return otlptracehttp.New(ctx)
 	}
-	// fmt.Println("using DSN:", dsn)
 
 	return otlptracehttp.New(
 		ctx,
 		otlptracehttp.WithEndpoint("otlp.uptrace.dev"),
 		otlptracehttp.WithHeaders(map[string]string{
 			// Set the Uptrace DSN here or use UPTRACE_DSN env var.
-			"uptrace-dsn": dsn,
+			"uptrace-dsn": os.Getenv(base.UPTRACE_DSN_ENV_VAR),
 		}),
 		otlptracehttp.WithCompression(otlptracehttp.GzipCompression),
 	)
 }
 
-func newTraceProvider(ctx context.Context, resource *resource.Resource) (*trace.TracerProvider, error) {
-	traceExporter, err := newTraceExporter(ctx)
+func newTraceProvider(ctx context.Context, exporter OTelExporter, resource *resource.Resource) (*trace.TracerProvider, error) {
+	traceExporter, err := newTraceExporter(ctx, exporter)
 	if err != nil {
 		return nil, err
 	}
@@ -140,13 +188,7 @@ func newTraceProvider(ctx context.Context, resource *resource.Resource) (*trace.
 	return traceProvider, nil
 }
 
-func newMeterExporter(ctx context.Context) (*otlpmetricgrpc.Exporter, error) {
-	dsn := os.Getenv(base.UPTRACE_DSN_ENV_VAR)
-	if dsn == "" {
-		panic(fmt.Sprintf("%s environment variable is required", base.UPTRACE_DSN_ENV_VAR))
-	}
-	// fmt.Println("using DSN:", dsn)
-
+func newMeterExporter(ctx context.Context, exporter OTelExporter) (metric.Exporter, error) {
 	preferDeltaTemporalitySelector := func(kind metric.InstrumentKind) metricdata.Temporality {
 		switch kind {
 		case metric.InstrumentKindCounter,
@@ -158,19 +200,27 @@ func newMeterExporter(ctx context.Context) (*otlpmetricgrpc.Exporter, error) {
 		}
 	}
 
+	switch exporter {
+	case OTelExporterStdout:
+		return stdoutmetric.New()
+	case OTelExporterOTLP:
+		// Over HTTP like traces and logs, so one OTEL_EXPORTER_OTLP_ENDPOINT reaches them all
+		return otlpmetrichttp.New(ctx)
+	}
+
 	return otlpmetricgrpc.New(ctx,
 		otlpmetricgrpc.WithEndpoint("otlp.uptrace.dev:4317"),
 		otlpmetricgrpc.WithHeaders(map[string]string{
 			// Set the Uptrace DSN here or use UPTRACE_DSN env var.
-			"uptrace-dsn": dsn,
+			"uptrace-dsn": os.Getenv(base.UPTRACE_DSN_ENV_VAR),
 		}),
 		otlpmetricgrpc.WithCompressor(gzip.Name),
 		otlpmetricgrpc.WithTemporalitySelector(preferDeltaTemporalitySelector),
 	)
 }
 
-func newMeterProvider(ctx context.Context, _ *resource.Resource) (*metric.MeterProvider, error) {
-	metricExporter, err := newMeterExporter(ctx)
+func newMeterProvider(ctx context.Context, exporter OTelExporter, _ *resource.Resource) (*metric.MeterProvider, error) {
+	metricExporter, err := newMeterExporter(ctx, exporter)
 	if err != nil {
 		return nil, err
 	}
@@ -186,24 +236,25 @@ func newMeterProvider(ctx context.Context, _ *resource.Resource) (*metric.MeterP
 	return meterProvider, nil
 }
 
-func newLoggerExporter(ctx context.Context) (*otlploghttp.Exporter, error) {
-	dsn := os.Getenv(base.UPTRACE_DSN_ENV_VAR)
-	if dsn == "" {
-		panic(fmt.Sprintf("%s environment variable is required", base.UPTRACE_DSN_ENV_VAR))
+func newLoggerExporter(ctx context.Context, exporter OTelExporter) (log.Exporter, error) {
+	switch exporter {
+	case OTelExporterStdout:
+		return stdoutlog.New()
+	case OTelExporterOTLP:
+		return otlploghttp.New(ctx)
 	}
-	// fmt.Println("using DSN:", dsn)
 
 	return otlploghttp.New(ctx,
 		otlploghttp.WithEndpoint("otlp.uptrace.dev"),
 		otlploghttp.WithHeaders(map[string]string{
-			"uptrace-dsn": dsn,
+			"uptrace-dsn": os.Getenv(base.UPTRACE_DSN_ENV_VAR),
 		}),
 		otlploghttp.WithCompression(otlploghttp.GzipCompression),
 	)
 }
 
-func newLoggerProvider(ctx context.Context) (*log.LoggerProvider, error) {
-	logExporter, err := newLoggerExporter(ctx)
+func newLoggerProvider(ctx context.Context, exporter OTelExporter) (*log.LoggerProvider, error) {
+	logExporter, err := newLoggerExporter(ctx, exporter)
 	if err != nil {
 		return nil, err
 	}
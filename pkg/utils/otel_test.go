@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"os"
+	"testing"
+
+	"aaronromeo.com/postmanpat/pkg/base"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOTelExporter(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		uptraceDSN string
+		expected   OTelExporter
+		wantErr    bool
+	}{
+		{name: "empty without a DSN", input: "", expected: OTelExporterNone},
+		{name: "empty with a DSN", input: "", uptraceDSN: "https://token@api.uptrace.dev/1", expected: OTelExporterUptrace},
+		{name: "none", input: "none", expected: OTelExporterNone},
+		{name: "none with a DSN", input: "none", uptraceDSN: "https://token@api.uptrace.dev/1", expected: OTelExporterNone},
+		{name: "stdout", input: "stdout", expected: OTelExporterStdout},
+		{name: "otlp", input: "otlp", expected: OTelExporterOTLP},
+		{name: "uptrace", input: "uptrace", expected: OTelExporterUptrace},
+		{name: "unknown", input: "jaeger", wantErr: true},
+		{name: "disabled is not a name", input: "disabled", wantErr: true},
+		{name: "names are case sensitive", input: "OTLP", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.uptraceDSN != "" {
+				t.Setenv(base.UPTRACE_DSN_ENV_VAR, tt.uptraceDSN)
+			} else {
+				// An empty value still counts as set, so it is removed. Setenv restores it afterwards.
+				t.Setenv(base.UPTRACE_DSN_ENV_VAR, "")
+				assert.NoError(t, os.Unsetenv(base.UPTRACE_DSN_ENV_VAR))
+			}
+
+			exporter, err := ParseOTelExporter(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, exporter)
+		})
+	}
+}
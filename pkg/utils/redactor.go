@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type RedactMode string
+
+const (
+	RedactNone     RedactMode = ""
+	RedactHash     RedactMode = "hash"
+	RedactTruncate RedactMode = "truncate"
+)
+
+// redactTruncateLength is the number of leading characters kept by RedactTruncate
+const redactTruncateLength = 4
+
+func ParseRedactMode(mode string) (RedactMode, error) {
+	switch RedactMode(mode) {
+	case RedactNone, RedactHash, RedactTruncate:
+		return RedactMode(mode), nil
+	default:
+		return RedactNone, errors.Errorf("unknown redact mode %q, expected one of %q or %q", mode, RedactHash, RedactTruncate)
+	}
+}
+
+// Redactor hides personal content (subjects, addresses, bodies) before it is logged or reported
+type Redactor struct {
+	Mode RedactMode
+}
+
+func (r Redactor) Redact(value string) string {
+	if value == "" {
+		return value
+	}
+
+	switch r.Mode {
+	case RedactHash:
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(value)))[:19]
+	case RedactTruncate:
+		runes := []rune(value)
+		if len(runes) <= redactTruncateLength {
+			return "..."
+		}
+		return string(runes[:redactTruncateLength]) + "..."
+	default:
+		return value
+	}
+}
+
+// RedactBytes redacts a body, returning nil when redaction is enabled
+func (r Redactor) RedactBytes(value []byte) []byte {
+	if r.Mode == RedactNone {
+		return value
+	}
+	return nil
+}
+
+// RedactError hides value wherever it shows up in the message of err, such as an export path
+// made from a subject within an *os.PathError. The redacted error still unwraps to err.
+func (r Redactor) RedactError(err error, value string) error {
+	if err == nil || r.Mode == RedactNone || value == "" || !strings.Contains(err.Error(), value) {
+		return err
+	}
+	return &redactedError{msg: strings.ReplaceAll(err.Error(), value, r.Redact(value)), err: err}
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+
+func (e *redactedError) Unwrap() error { return e.err }
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRedactMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected RedactMode
+		wantErr  bool
+	}{
+		{name: "none", input: "", expected: RedactNone},
+		{name: "hash", input: "hash", expected: RedactHash},
+		{name: "truncate", input: "truncate", expected: RedactTruncate},
+		{name: "unknown", input: "mask", expected: RedactNone, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode, err := ParseRedactMode(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected, mode)
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     RedactMode
+		input    string
+		expected string
+	}{
+		{name: "none keeps the value", mode: RedactNone, input: "Quarterly results", expected: "Quarterly results"},
+		{name: "hash", mode: RedactHash, input: "Quarterly results", expected: "sha256:1d809cf070ce"},
+		{name: "truncate", mode: RedactTruncate, input: "Quarterly results", expected: "Quar..."},
+		{name: "truncate on runes", mode: RedactTruncate, input: "Überweisung", expected: "Über..."},
+		{name: "truncate short value", mode: RedactTruncate, input: "Hi", expected: "..."},
+		{name: "hash empty value", mode: RedactHash, input: "", expected: ""},
+		{name: "truncate empty value", mode: RedactTruncate, input: "", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, Redactor{Mode: tt.mode}.Redact(tt.input))
+		})
+	}
+}
+
+func TestRedactBytes(t *testing.T) {
+	body := []byte("Dear Alex")
+
+	assert.Equal(t, body, Redactor{Mode: RedactNone}.RedactBytes(body))
+	assert.Nil(t, Redactor{Mode: RedactHash}.RedactBytes(body))
+	assert.Nil(t, Redactor{Mode: RedactTruncate}.RedactBytes(body))
+}
+
+func TestRedactError(t *testing.T) {
+	folder := "exports/INBOX/20240102T030405Z-Quarterly_results-0a1b"
+	pathErr := &fs.PathError{Op: "mkdir", Path: folder + "/metadata.json", Err: fs.ErrPermission}
+
+	tests := []struct {
+		name     string
+		mode     RedactMode
+		expected string
+	}{
+		{name: "none", mode: RedactNone, expected: "mkdir " + folder + "/metadata.json: permission denied"},
+		{name: "hash", mode: RedactHash, expected: "mkdir " + Redactor{Mode: RedactHash}.Redact(folder) + "/metadata.json: permission denied"},
+		{name: "truncate", mode: RedactTruncate, expected: "mkdir expo.../metadata.json: permission denied"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Redactor{Mode: tt.mode}.RedactError(pathErr, folder)
+			assert.EqualError(t, err, tt.expected)
+			if tt.mode != RedactNone {
+				assert.NotContains(t, err.Error(), "Quarterly")
+			}
+			assert.ErrorIs(t, err, os.ErrPermission)
+		})
+	}
+}
+
+func TestRedactErrorLeavesOtherErrors(t *testing.T) {
+	redactor := Redactor{Mode: RedactHash}
+	err := errors.New("bucket not found")
+
+	assert.Same(t, err, redactor.RedactError(err, "exports/INBOX"))
+	assert.NoError(t, redactor.RedactError(nil, "exports/INBOX"))
+}
@@ -3,111 +3,195 @@ package utils
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+// IsNotExist reports whether a FileManager error means the file doesn't exist
+func IsNotExist(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code() == s3.ErrCodeNoSuchKey
+	}
+	return false
+}
+
+// Writer streams a file to storage, the file is only complete once Close returns without error
 type Writer interface {
 	Write(p []byte) (n int, err error)
 	Flush() error
+	Close() error
 }
 
 type FileManager interface {
 	Close() error
+	// Create streams a new file, so large files never have to be held in memory
 	Create(name string) (Writer, error)
+	// Open streams an existing file, the caller closes it
+	Open(name string) (io.ReadCloser, error)
 	MkdirAll(path string, perm os.FileMode) error
 	WriteFile(filename string, data []byte, perm os.FileMode) error
 	ReadFile(filename string) ([]byte, error)
 }
 
-type OSFileManager struct {
-	Outfile *os.File
-	Writer  Writer
+type OSFileManager struct{}
+
+// osWriter buffers writes to a local file
+type osWriter struct {
+	*bufio.Writer
+	file *os.File
+}
+
+func (osw *osWriter) Close() error {
+	if err := osw.Flush(); err != nil {
+		osw.file.Close() //nolint:errcheck
+		return err
+	}
+	return osw.file.Close()
 }
 
 func (osfc OSFileManager) Create(name string) (Writer, error) {
-	var err error
-	osfc.Outfile, err = os.Create(name)
+	file, err := os.Create(filepath.FromSlash(name))
 	if err != nil {
 		return nil, err
 	}
-	osfc.Writer = bufio.NewWriter(osfc.Outfile)
-	return osfc.Writer, nil
+	return &osWriter{Writer: bufio.NewWriter(file), file: file}, nil
 }
 
-func (osfc OSFileManager) Close() error {
-	if err := osfc.Writer.Flush(); err != nil {
-		return err
-	}
-	if err := osfc.Outfile.Close(); err != nil {
-		return err
-	}
+func (osfc OSFileManager) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.FromSlash(name))
+}
 
+// Close is a no-op, every file closes itself
+func (osfc OSFileManager) Close() error {
 	return nil
 }
 
 func (osfc OSFileManager) MkdirAll(path string, perm os.FileMode) error {
-	return os.MkdirAll(path, perm)
+	return os.MkdirAll(filepath.FromSlash(path), perm)
 }
 
 func (osfc OSFileManager) WriteFile(filename string, data []byte, perm os.FileMode) error {
-	return os.WriteFile(filename, data, perm)
+	return os.WriteFile(filepath.FromSlash(filename), data, perm)
 }
 
 func (osfc OSFileManager) ReadFile(filename string) ([]byte, error) {
-	return os.ReadFile(filename)
+	return os.ReadFile(filepath.FromSlash(filename))
+}
+
+// uploader sends a file to S3 from a reader, s3manager.Uploader splits it into a multipart upload
+type uploader interface {
+	Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error)
 }
 
 type S3FileManager struct {
-	svc    *s3.S3
-	bucket string
-	folder string
-	writer *S3Writer
-	objKey string
+	svc          s3iface.S3API
+	uploader     uploader
+	bucket       string
+	folder       string
+	storageClass string
+}
+
+type S3FileManagerOption func(*S3FileManager)
+
+// WithStorageClass writes every file in the storage class, e.g. STANDARD_IA or GLACIER, instead of
+// the bucket's default. Folder markers from MkdirAll are left in the default.
+func WithStorageClass(storageClass string) S3FileManagerOption {
+	return func(s3fm *S3FileManager) {
+		s3fm.storageClass = storageClass
+	}
 }
 
-func NewS3FileManager(sess *session.Session, bucket, folder string) *S3FileManager {
-	return &S3FileManager{
+func NewS3FileManager(sess *session.Session, bucket, folder string, opts ...S3FileManagerOption) *S3FileManager {
+	s3fm := &S3FileManager{
 		svc:    s3.New(sess),
 		bucket: bucket,
 		folder: folder,
 	}
+	for _, opt := range opts {
+		opt(s3fm)
+	}
+	s3fm.uploader = s3manager.NewUploaderWithClient(s3fm.svc)
+	return s3fm
+}
+
+// storageClassValue is the storage class to send with a write, nil leaves the bucket default
+func (s3fm *S3FileManager) storageClassValue() *string {
+	if s3fm.storageClass == "" {
+		return nil
+	}
+	return aws.String(s3fm.storageClass)
 }
 
+// key builds the object key for a file, object keys always use forward slashes
+func (s3fm *S3FileManager) key(name string) string {
+	return path.Join(s3fm.folder, filepath.ToSlash(name))
+}
+
+// Create streams the file to S3 as a multipart upload, so only the part being sent is held in memory
 func (s3fm *S3FileManager) Create(name string) (Writer, error) {
-	s3fm.objKey = filepath.Join(s3fm.folder, name)
-	s3fm.writer = new(S3Writer)
-	return s3fm.writer, nil
+	reader, writer := io.Pipe()
+	s3w := &S3Writer{pipe: writer, done: make(chan error, 1)}
+
+	go func() {
+		_, err := s3fm.uploader.Upload(&s3manager.UploadInput{
+			Bucket:       aws.String(s3fm.bucket),
+			Key:          aws.String(s3fm.key(name)),
+			Body:         reader,
+			StorageClass: s3fm.storageClassValue(),
+		})
+		// Unblock any write still waiting on a failed upload
+		reader.CloseWithError(err) //nolint:errcheck
+		s3w.done <- err
+	}()
+
+	return s3w, nil
+}
+
+func (s3fm *S3FileManager) Open(name string) (io.ReadCloser, error) {
+	obj, err := s3fm.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s3fm.bucket),
+		Key:    aws.String(s3fm.key(name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return obj.Body, nil
 }
 
+// Close is a no-op, every file closes itself
 func (s3fm *S3FileManager) Close() error {
-	// _, err := s3fm.svc.PutObject(&s3.PutObjectInput{
-	// 	Bucket: aws.String(s3fm.bucket),
-	// 	Key:    aws.String(s3fm.objKey),
-	// 	Body:   bytes.NewReader((*s3fm.writer).buffer.Bytes()),
-	// })
-	// return err
 	return nil
 }
 
 func (s3fm *S3FileManager) MkdirAll(path string, perm os.FileMode) error {
 	_, err := s3fm.svc.PutObject(&s3.PutObjectInput{
 		Bucket: aws.String(s3fm.bucket),
-		Key:    aws.String(filepath.Join(s3fm.folder, path) + "/"),
+		Key:    aws.String(s3fm.key(path) + "/"),
 	})
 	return err
 }
 
 func (s3fm *S3FileManager) WriteFile(filename string, data []byte, perm os.FileMode) error {
 	_, err := s3fm.svc.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(s3fm.bucket),
-		Key:    aws.String(filepath.Join(s3fm.folder, filename)),
-		Body:   bytes.NewReader(data),
+		Bucket:       aws.String(s3fm.bucket),
+		Key:          aws.String(s3fm.key(filename)),
+		Body:         bytes.NewReader(data),
+		StorageClass: s3fm.storageClassValue(),
 	})
 	return err
 }
@@ -115,7 +199,7 @@ func (s3fm *S3FileManager) WriteFile(filename string, data []byte, perm os.FileM
 func (s3fm *S3FileManager) ReadFile(filename string) ([]byte, error) {
 	obj, err := s3fm.svc.GetObject(&s3.GetObjectInput{
 		Bucket: aws.String(s3fm.bucket),
-		Key:    aws.String(filepath.Join(s3fm.folder, filename)),
+		Key:    aws.String(s3fm.key(filename)),
 	})
 	if err != nil {
 		return nil, err
@@ -165,15 +249,143 @@ func (s3fm *S3FileManager) CreateBucket(bucket string) error {
 	return nil
 }
 
-// S3Writer struct implementing Writer interface for S3
+// LifecycleRule moves the files under a folder to a cheaper storage class, and later deletes them,
+// a number of days after they were written. Zero days leaves that step out.
+type LifecycleRule struct {
+	Folder                 string
+	TransitionDays         int64
+	TransitionStorageClass string
+	ExpirationDays         int64
+}
+
+func (rule LifecycleRule) validate() error {
+	if rule.TransitionDays < 0 || rule.ExpirationDays < 0 {
+		return errors.New("lifecycle days must not be negative")
+	}
+	if rule.TransitionDays > 0 && rule.TransitionStorageClass == "" {
+		return errors.New("a lifecycle transition needs a storage class")
+	}
+	if rule.TransitionDays > 0 && rule.ExpirationDays > 0 && rule.ExpirationDays <= rule.TransitionDays {
+		return errors.New("lifecycle expiration must come after the transition")
+	}
+	return nil
+}
+
+// PutLifecycleRule sets the lifecycle of a folder of this file manager. The bucket is shared, so
+// the rule is merged into the bucket's configuration, replacing only an earlier rule for the folder.
+// The configuration is only written when the rule has changed.
+func (s3fm *S3FileManager) PutLifecycleRule(rule LifecycleRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+
+	prefix := s3fm.key(rule.Folder) + "/"
+	ruleID := "postmanpat:" + prefix
+
+	var lifecycleRule *s3.LifecycleRule
+	if rule.TransitionDays > 0 || rule.ExpirationDays > 0 {
+		lifecycleRule = &s3.LifecycleRule{
+			ID:     aws.String(ruleID),
+			Status: aws.String(s3.ExpirationStatusEnabled),
+			Filter: &s3.LifecycleRuleFilter{Prefix: aws.String(prefix)},
+		}
+		if rule.TransitionDays > 0 {
+			lifecycleRule.Transitions = []*s3.Transition{{
+				Days:         aws.Int64(rule.TransitionDays),
+				StorageClass: aws.String(rule.TransitionStorageClass),
+			}}
+		}
+		if rule.ExpirationDays > 0 {
+			lifecycleRule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(rule.ExpirationDays)}
+		}
+	}
+
+	var rules []*s3.LifecycleRule
+	current, err := s3fm.svc.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(s3fm.bucket),
+	})
+	var aerr awserr.Error
+	switch {
+	case errors.As(err, &aerr) && aerr.Code() == "NoSuchLifecycleConfiguration":
+		if lifecycleRule == nil {
+			return nil
+		}
+	case err != nil:
+		return err
+	default:
+		var existingRule *s3.LifecycleRule
+		for _, existing := range current.Rules {
+			if aws.StringValue(existing.ID) == ruleID {
+				existingRule = existing
+			} else {
+				rules = append(rules, existing)
+			}
+		}
+		// Leave the bucket alone when it already has the rule, or has no rule to remove
+		if sameLifecycleRule(existingRule, lifecycleRule) {
+			return nil
+		}
+	}
+
+	if lifecycleRule != nil {
+		rules = append(rules, lifecycleRule)
+	}
+
+	if len(rules) == 0 {
+		_, err = s3fm.svc.DeleteBucketLifecycle(&s3.DeleteBucketLifecycleInput{Bucket: aws.String(s3fm.bucket)})
+		return err
+	}
+	_, err = s3fm.svc.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(s3fm.bucket),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: rules},
+	})
+	return err
+}
+
+// sameLifecycleRule compares the parts of a rule PutLifecycleRule sets, nil is no rule
+func sameLifecycleRule(a, b *s3.LifecycleRule) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if aws.StringValue(a.Status) != aws.StringValue(b.Status) {
+		return false
+	}
+	if a.Filter == nil || aws.StringValue(a.Filter.Prefix) != aws.StringValue(b.Filter.Prefix) {
+		return false
+	}
+	if len(a.Transitions) != len(b.Transitions) {
+		return false
+	}
+	for i := range a.Transitions {
+		if aws.Int64Value(a.Transitions[i].Days) != aws.Int64Value(b.Transitions[i].Days) ||
+			aws.StringValue(a.Transitions[i].StorageClass) != aws.StringValue(b.Transitions[i].StorageClass) {
+			return false
+		}
+	}
+	if (a.Expiration == nil) != (b.Expiration == nil) {
+		return false
+	}
+	return a.Expiration == nil || aws.Int64Value(a.Expiration.Days) == aws.Int64Value(b.Expiration.Days)
+}
+
+// S3Writer feeds a file being uploaded by Create
 type S3Writer struct {
-	buffer *bytes.Buffer
+	pipe *io.PipeWriter
+	done chan error
 }
 
 func (s3w *S3Writer) Write(p []byte) (n int, err error) {
-	return s3w.buffer.Write(p)
+	return s3w.pipe.Write(p)
 }
 
 func (s3w *S3Writer) Flush() error {
-	return nil // No action needed for flush in this implementation
+	return nil // Parts are sent as they fill up
+}
+
+// Close ends the file and waits for the upload to finish
+func (s3w *S3Writer) Close() error {
+	if err := s3w.pipe.Close(); err != nil {
+		return err
+	}
+	return <-s3w.done
 }
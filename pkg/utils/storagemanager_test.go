@@ -0,0 +1,261 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLifecycleS3 keeps a bucket lifecycle configuration in memory, nil is a bucket without one
+type fakeLifecycleS3 struct {
+	s3iface.S3API
+
+	lifecycle *s3.BucketLifecycleConfiguration
+	puts      int
+	deletes   int
+}
+
+func (f *fakeLifecycleS3) GetBucketLifecycleConfiguration(*s3.GetBucketLifecycleConfigurationInput) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	if f.lifecycle == nil {
+		return nil, awserr.New("NoSuchLifecycleConfiguration", "The lifecycle configuration does not exist", nil)
+	}
+	return &s3.GetBucketLifecycleConfigurationOutput{Rules: f.lifecycle.Rules}, nil
+}
+
+func (f *fakeLifecycleS3) PutBucketLifecycleConfiguration(input *s3.PutBucketLifecycleConfigurationInput) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	f.puts++
+	f.lifecycle = input.LifecycleConfiguration
+	return &s3.PutBucketLifecycleConfigurationOutput{}, nil
+}
+
+func (f *fakeLifecycleS3) DeleteBucketLifecycle(*s3.DeleteBucketLifecycleInput) (*s3.DeleteBucketLifecycleOutput, error) {
+	f.deletes++
+	f.lifecycle = nil
+	return &s3.DeleteBucketLifecycleOutput{}, nil
+}
+
+func (f *fakeLifecycleS3) ruleIDs() []string {
+	if f.lifecycle == nil {
+		return nil
+	}
+	ids := []string{}
+	for _, rule := range f.lifecycle.Rules {
+		ids = append(ids, aws.StringValue(rule.ID))
+	}
+	return ids
+}
+
+// otherToolRule is a rule some other tool keeps on the shared bucket
+func otherToolRule() *s3.LifecycleRule {
+	return &s3.LifecycleRule{
+		ID:         aws.String("expire-logs"),
+		Status:     aws.String(s3.ExpirationStatusEnabled),
+		Filter:     &s3.LifecycleRuleFilter{Prefix: aws.String("logs/")},
+		Expiration: &s3.LifecycleExpiration{Days: aws.Int64(7)},
+	}
+}
+
+// exportsRule is the rule PutLifecycleRule writes for the exports folder of the test account
+func exportsRule(transitionDays, expirationDays int64) *s3.LifecycleRule {
+	rule := &s3.LifecycleRule{
+		ID:     aws.String("postmanpat:clark@example.com/exportedemails/"),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("clark@example.com/exportedemails/")},
+	}
+	if transitionDays > 0 {
+		rule.Transitions = []*s3.Transition{{Days: aws.Int64(transitionDays), StorageClass: aws.String("GLACIER")}}
+	}
+	if expirationDays > 0 {
+		rule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(expirationDays)}
+	}
+	return rule
+}
+
+func TestPutLifecycleRule(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    []*s3.LifecycleRule
+		rule        LifecycleRule
+		wantRules   []*s3.LifecycleRule
+		wantPuts    int
+		wantDeletes int
+	}{
+		{
+			name:      "bucket without a lifecycle",
+			rule:      LifecycleRule{Folder: "exportedemails", TransitionDays: 30, TransitionStorageClass: "GLACIER", ExpirationDays: 365},
+			wantRules: []*s3.LifecycleRule{exportsRule(30, 365)},
+			wantPuts:  1,
+		},
+		{
+			name:      "keeps the rules of other tools",
+			existing:  []*s3.LifecycleRule{otherToolRule()},
+			rule:      LifecycleRule{Folder: "exportedemails", ExpirationDays: 365},
+			wantRules: []*s3.LifecycleRule{otherToolRule(), exportsRule(0, 365)},
+			wantPuts:  1,
+		},
+		{
+			name:      "replaces its own rule instead of adding another",
+			existing:  []*s3.LifecycleRule{exportsRule(30, 365), otherToolRule()},
+			rule:      LifecycleRule{Folder: "exportedemails", TransitionDays: 60, TransitionStorageClass: "GLACIER", ExpirationDays: 365},
+			wantRules: []*s3.LifecycleRule{otherToolRule(), exportsRule(60, 365)},
+			wantPuts:  1,
+		},
+		{
+			name:      "zero days removes its own rule",
+			existing:  []*s3.LifecycleRule{otherToolRule(), exportsRule(30, 365)},
+			rule:      LifecycleRule{Folder: "exportedemails"},
+			wantRules: []*s3.LifecycleRule{otherToolRule()},
+			wantPuts:  1,
+		},
+		{
+			name:        "zero days deletes a lifecycle left empty",
+			existing:    []*s3.LifecycleRule{exportsRule(30, 365)},
+			rule:        LifecycleRule{Folder: "exportedemails"},
+			wantDeletes: 1,
+		},
+		{
+			name: "zero days on a bucket without a lifecycle",
+			rule: LifecycleRule{Folder: "exportedemails"},
+		},
+		{
+			name:      "zero days without its own rule",
+			existing:  []*s3.LifecycleRule{otherToolRule()},
+			rule:      LifecycleRule{Folder: "exportedemails"},
+			wantRules: []*s3.LifecycleRule{otherToolRule()},
+		},
+		{
+			name:      "an unchanged rule isn't written",
+			existing:  []*s3.LifecycleRule{otherToolRule(), exportsRule(30, 365)},
+			rule:      LifecycleRule{Folder: "exportedemails", TransitionDays: 30, TransitionStorageClass: "GLACIER", ExpirationDays: 365},
+			wantRules: []*s3.LifecycleRule{otherToolRule(), exportsRule(30, 365)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &fakeLifecycleS3{}
+			if tt.existing != nil {
+				svc.lifecycle = &s3.BucketLifecycleConfiguration{Rules: tt.existing}
+			}
+			s3fm := &S3FileManager{svc: svc, bucket: "postmanpat", folder: "clark@example.com"}
+
+			assert.NoError(t, s3fm.PutLifecycleRule(tt.rule))
+
+			if tt.wantRules == nil {
+				assert.Nil(t, svc.lifecycle)
+			} else {
+				assert.Equal(t, tt.wantRules, svc.lifecycle.Rules)
+			}
+			assert.Equal(t, tt.wantPuts, svc.puts)
+			assert.Equal(t, tt.wantDeletes, svc.deletes)
+		})
+	}
+}
+
+func TestPutLifecycleRuleRejectsInvalidRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule LifecycleRule
+	}{
+		{name: "negative days", rule: LifecycleRule{Folder: "exportedemails", ExpirationDays: -1}},
+		{name: "transition without a storage class", rule: LifecycleRule{Folder: "exportedemails", TransitionDays: 30}},
+		{name: "expiration before the transition", rule: LifecycleRule{Folder: "exportedemails", TransitionDays: 30, TransitionStorageClass: "GLACIER", ExpirationDays: 30}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &fakeLifecycleS3{lifecycle: &s3.BucketLifecycleConfiguration{Rules: []*s3.LifecycleRule{otherToolRule()}}}
+			s3fm := &S3FileManager{svc: svc, bucket: "postmanpat", folder: "clark@example.com"}
+
+			assert.Error(t, s3fm.PutLifecycleRule(tt.rule))
+			assert.Equal(t, []string{"expire-logs"}, svc.ruleIDs())
+			assert.Zero(t, svc.puts)
+		})
+	}
+}
+
+// fakeUploader reads the body like s3manager does, then holds the upload open until release is
+// closed and fails it with err
+type fakeUploader struct {
+	input    *s3manager.UploadInput
+	body     []byte
+	readBody bool
+	release  chan struct{}
+	err      error
+	returned chan struct{}
+}
+
+func newFakeUploader(readBody bool, err error) *fakeUploader {
+	return &fakeUploader{readBody: readBody, err: err, release: make(chan struct{}), returned: make(chan struct{})}
+}
+
+func (f *fakeUploader) Upload(input *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	defer close(f.returned)
+	f.input = input
+	if f.readBody {
+		body, err := io.ReadAll(input.Body)
+		if err != nil {
+			return nil, err
+		}
+		f.body = body
+	}
+	<-f.release
+	return &s3manager.UploadOutput{}, f.err
+}
+
+func TestS3WriterCloseWaitsForTheUpload(t *testing.T) {
+	for _, uploadErr := range []error{nil, errors.New("upload failed")} {
+		up := newFakeUploader(true, uploadErr)
+		s3fm := &S3FileManager{uploader: up, bucket: "postmanpat", folder: "clark@example.com", storageClass: "STANDARD_IA"}
+
+		writer, err := s3fm.Create("exportedemails/INBOX.mbox")
+		assert.NoError(t, err)
+		_, err = writer.Write([]byte("From clark@example.com\n"))
+		assert.NoError(t, err)
+
+		closed := make(chan error, 1)
+		go func() { closed <- writer.Close() }()
+
+		select {
+		case <-closed:
+			t.Fatal("Close returned before the upload finished")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(up.release)
+		assert.Equal(t, uploadErr, <-closed)
+		assert.Equal(t, "From clark@example.com\n", string(up.body))
+		assert.Equal(t, "clark@example.com/exportedemails/INBOX.mbox", aws.StringValue(up.input.Key))
+		assert.Equal(t, "STANDARD_IA", aws.StringValue(up.input.StorageClass))
+	}
+}
+
+func TestS3WriterWriteReturnsAFailedUpload(t *testing.T) {
+	uploadErr := errors.New("access denied")
+	// The upload fails before reading any of the body
+	up := newFakeUploader(false, uploadErr)
+	close(up.release)
+	s3fm := &S3FileManager{uploader: up, bucket: "postmanpat", folder: "clark@example.com"}
+
+	writer, err := s3fm.Create("exportedemails/INBOX.mbox")
+	assert.NoError(t, err)
+
+	_, err = writer.Write([]byte("From clark@example.com\n"))
+	assert.ErrorIs(t, err, uploadErr)
+
+	// The upload goroutine finishes without Close being called, its error waits in the buffer
+	<-up.returned
+	s3w := writer.(*S3Writer)
+	assert.Eventually(t, func() bool { return len(s3w.done) == 1 }, time.Second, time.Millisecond)
+
+	// Closing anyway still reports the failure
+	assert.ErrorIs(t, writer.Close(), uploadErr)
+}